@@ -1,16 +1,68 @@
 package cmd
 
 import (
-	"bytes"
 	"github.com/iangrunert/git-ratchet/store"
 	log "github.com/spf13/jwalterweatherman"
 	"io"
+	"path/filepath"
 )
 
-func Check(prefix string, slack float64, usePercents bool, write bool, inputType string, zeroOnMissing bool, input io.Reader) int {
+// CheckOptions configures a check. Empty fields are taken from the repository
+// config file.
+type CheckOptions struct {
+	Prefix string
+	Write  bool
+	// Push shares the written measures, merging in any pushed by others since.
+	Push bool
+	// Fetch reads the measures shared by others before checking.
+	Fetch bool
+	// Remote is the remote to fetch from and push to, overriding the config.
+	Remote string
+	// RequireBaseline fails the check when there may be stored measures which
+	// couldn't be read, because the notes weren't fetched or the clone is
+	// shallow. Otherwise the check passes as if it were the first run, but
+	// doesn't write the measures over ones it couldn't read.
+	RequireBaseline bool
+	// Base compares against the history of the named branch, from its
+	// merge-base with HEAD, as for a pull request into it.
+	Base string
+	// AllParents searches every parent of merge commits for stored measures.
+	// By default only first parents are followed, so measures stored on
+	// merged branches aren't used.
+	AllParents bool
+	// ConfigFile is the config file to read. When empty, the default config
+	// file is read if it exists.
+	ConfigFile string
+	InputType  string
+	GroupBy    []string
+	// Overrides replace the policy of every measure in the config file.
+	Overrides store.MeasureConfig
+	// Format is the format of the report written to Output: text, which
+	// writes nothing beyond the log, json, github, gitlab or markdown.
+	Format string
+	Output io.Writer
+	// Store is where measures are read from and written to. When nil, the
+	// store declared in the config file is opened.
+	Store store.Store
+	// Version is the git-ratchet version recorded with the measures written.
+	Version string
+}
+
+func Check(opts CheckOptions, input io.Reader) int {
+	if err := checkFormat(opts.Format); err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	config, err := loadConfig(opts)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
 	// Parse the measures from stdin
 	log.INFO.Println("Parsing measures from stdin")
-	passedMeasures, err := store.ParseMeasures(input, store.ParseInputType(inputType))
+	passedMeasures, err := store.ParseMeasures(input, store.ParseInputType(config.InputType), config.GroupBy)
 	log.INFO.Println("Finished parsing measures from stdin")
 	log.INFO.Println(passedMeasures)
 	if err != nil {
@@ -18,12 +70,31 @@ func Check(prefix string, slack float64, usePercents bool, write bool, inputType
 		return 10
 	}
 
-	log.INFO.Println("Reading measures stored in git")
-	gitlog := store.CommitMeasureCommand(prefix)
-	var stderr bytes.Buffer
-	gitlog.Stderr = &stderr
+	return ratchetMeasures(opts, config, passedMeasures)
+}
+
+// ratchetMeasures compares the passed measures against the most recent stored
+// measures, and writes them if requested.
+func ratchetMeasures(opts CheckOptions, config store.Config, passedMeasures []store.Measure) int {
+	config.ApplyDirections(passedMeasures)
 
-	readStoredMeasure, err := store.CommitMeasures(gitlog)
+	s, err := openStore(opts, config)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 20
+	}
+
+	if config.Store.Fetch {
+		log.INFO.Println("Fetching stored measures")
+		err = s.Fetch()
+		if err != nil {
+			log.FATAL.Println(err)
+			return 20
+		}
+	}
+
+	log.INFO.Println("Reading stored measures")
+	readStoredMeasure, err := s.CommitMeasures(historyOptions(opts))
 	if err != nil {
 		log.FATAL.Println(err)
 		return 20
@@ -31,34 +102,85 @@ func Check(prefix string, slack float64, usePercents bool, write bool, inputType
 
 	commitmeasure, err := readStoredMeasure()
 
+	write := opts.Write
+	if err == store.ErrNoNotes || err == store.ErrShallowHistory {
+		if opts.RequireBaseline {
+			log.FATAL.Println(err)
+			return 80
+		}
+		log.WARN.Println(err)
+		if write {
+			log.WARN.Println("Not writing measures, as there may be stored measures which couldn't be read.")
+			write = false
+		}
+		err = io.EOF
+	}
+
+	report := Report{Prefix: opts.Prefix, Passed: true}
+
 	// Empty state of the repository - no stored metrics. Let's store one if we can.
 	if err == io.EOF {
 		log.INFO.Println("No measures found.")
 		if write {
 			log.INFO.Println("Writing initial measure values.")
-			err = store.PutMeasures(prefix, passedMeasures)
+			err = s.PutMeasures(passedMeasures, runInfo(opts, config, passedMeasures))
 			if err != nil {
 				log.FATAL.Println(err)
 				return 30
 			}
 			log.INFO.Println("Successfully written initial measures.")
+
+			if code := push(opts, s); code != 0 {
+				return code
+			}
+		}
+
+		report.Measures = store.NewResults(passedMeasures)
+
+		err = writeReport(opts, report)
+		if err != nil {
+			log.FATAL.Println(err)
+			return 60
 		}
 	} else if err != nil {
 		log.FATAL.Println(err)
 		return 40
 	} else {
 		log.INFO.Println("Checking passed measure against stored value")
-		finalMeasures, compareErr := store.CompareMeasures(prefix, commitmeasure.CommitHash, commitmeasure.Measures, passedMeasures, slack, usePercents, zeroOnMissing)
+		finalMeasures, results, compareErr := store.CompareMeasures(s, commitmeasure.CommitHash, commitmeasure.Measures, passedMeasures, config)
 
-		if write {
+		report.BaselineCommit = commitmeasure.CommitHash
+		report.BaselineCommitter = commitmeasure.Committer
+		report.Measures = results
+		report.Passed = compareErr == nil
+
+		// Only a comparison which was made can be written; anything else
+		// would store the passed measures over the baseline unchecked.
+		if compareErr != nil && compareErr != store.ErrMeasuresFailing && compareErr != store.ErrNoStoredMeasures {
+			log.FATAL.Println(compareErr)
+			return 40
+		}
+
+		if opts.Write {
 			log.INFO.Println("Writing measure values.")
-			err = store.PutMeasures(prefix, finalMeasures)
+			err = s.PutMeasures(finalMeasures, runInfo(opts, config, finalMeasures))
 			if err != nil {
 				log.FATAL.Println(err)
 				return 30
 			}
 			log.INFO.Println("Successfully written measures.")
+
+			if code := push(opts, s); code != 0 {
+				return code
+			}
 		}
+
+		err = writeReport(opts, report)
+		if err != nil {
+			log.FATAL.Println(err)
+			return 60
+		}
+
 		if compareErr != nil {
 			log.FATAL.Println(compareErr)
 			return 50
@@ -67,6 +189,85 @@ func Check(prefix string, slack float64, usePercents bool, write bool, inputType
 		}
 	}
 
-	log.INFO.Println("Finished reading measures stored in git")
+	log.INFO.Println("Finished reading stored measures")
+	return 0
+}
+
+// loadConfig reads the repository config file and layers the options given on
+// the command line over it.
+func loadConfig(opts CheckOptions) (store.Config, error) {
+	path := opts.ConfigFile
+	if path == "" {
+		// The default config file sits at the root of the worktree, wherever
+		// in it the command runs.
+		root, err := store.RepositoryRoot()
+		if err != nil {
+			return store.Config{}, err
+		}
+		path = filepath.Join(root, store.DefaultConfigFile)
+	}
+
+	log.INFO.Printf("Reading config from %s", path)
+	config, err := store.LoadConfig(path, opts.ConfigFile != "")
+	if err != nil {
+		return config, err
+	}
+
+	if opts.InputType != "" {
+		config.InputType = opts.InputType
+	}
+	if config.InputType == "" {
+		config.InputType = "csv"
+	}
+	if len(opts.GroupBy) > 0 {
+		config.GroupBy = opts.GroupBy
+	}
+	config.Overrides = opts.Overrides
+	if opts.Remote != "" {
+		config.Store.Remote = opts.Remote
+	}
+	if opts.Fetch {
+		config.Store.Fetch = true
+	}
+
+	return config, nil
+}
+
+func historyOptions(opts CheckOptions) store.HistoryOptions {
+	return store.HistoryOptions{Base: opts.Base, FirstParent: !opts.AllParents}
+}
+
+// push pushes the store when asked to.
+func push(opts CheckOptions, s store.Store) int {
+	if !opts.Push {
+		return 0
+	}
+
+	log.INFO.Println("Pushing measures.")
+	err := s.Push()
+	if err != nil {
+		log.FATAL.Println(err)
+		return 70
+	}
+	log.INFO.Println("Successfully pushed measures.")
 	return 0
 }
+
+// runInfo describes the check storing the measures.
+func runInfo(opts CheckOptions, config store.Config, measures []store.Measure) store.RunInfo {
+	policies := make(map[string]store.Policy)
+	for _, m := range measures {
+		policies[m.Name] = config.PolicyFor(m.Name)
+	}
+
+	return store.RunInfo{Tool: opts.Version, Build: store.CIBuild(), InputType: config.InputType, Policies: policies}
+}
+
+// openStore opens the store for the options, falling back to the store
+// declared in the config file.
+func openStore(opts CheckOptions, config store.Config) (store.Store, error) {
+	if opts.Store != nil {
+		return opts.Store, nil
+	}
+	return store.OpenStore(config.Store, opts.Prefix)
+}
@@ -1,21 +1,34 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/iangrunert/git-ratchet/store"
 	log "github.com/spf13/jwalterweatherman"
 )
 
 var checkStyleFile *os.File
 var checkStyleFileErr error
+var junitFile *os.File
+var junitFileErr error
+var sarifFile *os.File
+var sarifFileErr error
 
 func TestMain(m *testing.M) {
 	checkStyleFile, checkStyleFileErr = os.Open("./testdata/output.xml")
+	junitFile, junitFileErr = os.Open("./testdata/junit.xml")
+	sarifFile, sarifFileErr = os.Open("./testdata/results.sarif")
 
 	os.Exit(m.Run())
 }
@@ -35,13 +48,13 @@ func TestCheck(t *testing.T) {
 
 	t.Logf("Running check command w: %t i: %s", false, "foo,6")
 
-	errCode := Check("", 0, false, true, "csv", false, strings.NewReader("foo,6"))
+	errCode := Check(CheckOptions{Write: true, InputType: "csv"}, strings.NewReader("foo,6"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
 	}
 
-	errCode = Check("", 0, false, true, "csv", false, strings.NewReader("foo,6"))
+	errCode = Check(CheckOptions{Write: true, InputType: "csv"}, strings.NewReader("foo,6"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
@@ -60,7 +73,7 @@ func TestZeroMissing(t *testing.T) {
 
 	t.Logf("Running check command w: %t i: %s", false, "")
 
-	errCode := Check("", 0, false, true, "csv", false, strings.NewReader(""))
+	errCode := Check(CheckOptions{Write: true, InputType: "csv"}, strings.NewReader(""))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
@@ -68,7 +81,7 @@ func TestZeroMissing(t *testing.T) {
 
 	t.Logf("Running check command zero on missing w: %t i: %s", false, "")
 
-	errCode = Check("", 0, false, true, "csv", false, strings.NewReader(""))
+	errCode = Check(CheckOptions{Write: true, InputType: "csv"}, strings.NewReader(""))
 
 	if errCode != 0 {
 		t.Fatalf("Check command failed unexpectedly!")
@@ -88,7 +101,7 @@ func TestAddRemove(t *testing.T) {
 
 	t.Logf("Running check command with added measure w: %t z: %t i: %s", false, false, "measure-A,5\nmeasure-B,4")
 
-	errCode := Check("", 0, false, true, "csv", false, strings.NewReader("measure-A,5\nmeasure-B,4"))
+	errCode := Check(CheckOptions{Write: true, InputType: "csv"}, strings.NewReader("measure-A,5\nmeasure-B,4"))
 
 	if errCode != 0 {
 		t.Fatalf("Check command failed unexpectedly!")
@@ -96,7 +109,7 @@ func TestAddRemove(t *testing.T) {
 
 	t.Logf("Running check command with added and removed measures w: %t z: %t i: %s", false, false, "measure-B,4\nmeasure-C,3")
 
-	errCode = Check("", 0, false, true, "csv", false, strings.NewReader("measure-B,4\nmeasure-C,3"))
+	errCode = Check(CheckOptions{Write: true, InputType: "csv"}, strings.NewReader("measure-B,4\nmeasure-C,3"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
@@ -104,7 +117,7 @@ func TestAddRemove(t *testing.T) {
 
 	t.Logf("Running check command with added and removed measures w: %t z: %t i: %s", false, true, "measure-B,4\nmeasure-C,3")
 
-	errCode = Check("", 0, false, true, "csv", true, strings.NewReader("measure-B,4\nmeasure-C,3"))
+	errCode = Check(CheckOptions{Write: true, InputType: "csv", Overrides: policy(0, false, true)}, strings.NewReader("measure-B,4\nmeasure-C,3"))
 
 	if errCode != 0 {
 		t.Fatalf("Check command failed unexpectedly!")
@@ -125,7 +138,7 @@ func TestCheckPrefix(t *testing.T) {
 
 	t.Logf("Running check command p: %s w: %t i: %s", "foobar", false, "foo,6")
 
-	errCode := Check("foobar", 0, false, false, "csv", false, strings.NewReader("foo,6"))
+	errCode := Check(CheckOptions{Prefix: "foobar", InputType: "csv"}, strings.NewReader("foo,6"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
@@ -148,7 +161,7 @@ func TestCheckSlackValue(t *testing.T) {
 
 	t.Logf("Running check command p: %s w: %t i: %s", "pageweight", false, "gzippedjs,16")
 
-	errCode := Check("pageweight", slack, usePercents, false, "csv", false, strings.NewReader("gzippedjs,16"))
+	errCode := Check(CheckOptions{Prefix: "pageweight", InputType: "csv", Overrides: policy(slack, usePercents, false)}, strings.NewReader("gzippedjs,16"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
@@ -171,7 +184,7 @@ func TestCheckSlackPercent(t *testing.T) {
 
 	t.Logf("Running check command p: %s w: %t i: %s", "pageweight", false, "gzippedjs,120")
 
-	errCode := Check("pageweight", slack, usePercents, false, "csv", false, strings.NewReader("gzippedjs,120"))
+	errCode := Check(CheckOptions{Prefix: "pageweight", InputType: "csv", Overrides: policy(slack, usePercents, false)}, strings.NewReader("gzippedjs,120"))
 
 	if errCode != 0 {
 		t.Fatalf("Check command failed unexpectedly!")
@@ -179,13 +192,157 @@ func TestCheckSlackPercent(t *testing.T) {
 
 	t.Logf("Running check command p: %s w: %t i: %s", "pageweight", false, "gzippedjs,121")
 
-	errCode = Check("pageweight", slack, usePercents, false, "csv", false, strings.NewReader("gzippedjs,121"))
+	errCode = Check(CheckOptions{Prefix: "pageweight", InputType: "csv", Overrides: policy(slack, usePercents, false)}, strings.NewReader("gzippedjs,121"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
 	}
 }
 
+func TestCheckDecimalValues(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	slack := 0.1
+	usePercents := false
+
+	runCheckPS(t, "bundle", slack, usePercents, true, "bundle.mb,1.25")
+	runCheckPS(t, "bundle", slack, usePercents, false, "bundle.mb,1.35")
+
+	t.Logf("Running check command p: %s w: %t i: %s", "bundle", false, "bundle.mb,1.36")
+
+	errCode := Check(CheckOptions{Prefix: "bundle", InputType: "csv", Overrides: policy(slack, usePercents, false)}, strings.NewReader("bundle.mb,1.36"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheckPS(t, "bundle", slack, usePercents, true, "bundle.mb,1.2")
+
+	checkString(t, "bundle.mb,1.2,1.2", strings.TrimSpace(runDump(t, "bundle").String()))
+
+	// Notes written before decimal support hold integers.
+	runCommand(t, repo, exec.Command("git", "notes", "--ref=git-ratchet-1-legacy", "add", "-m", "foo,5,5"))
+
+	t.Logf("Running check command p: %s w: %t i: %s", "legacy", false, "foo,5.5")
+
+	errCode = Check(CheckOptions{Prefix: "legacy", InputType: "csv"}, strings.NewReader("foo,5.5"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheckP(t, "legacy", false, "foo,4.5")
+}
+
+func TestCheckHigherIsBetter(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
+
+	runCheckP(t, "coverage", true, "coverage,80,,higher")
+
+	t.Logf("Running check command p: %s w: %t i: %s", "coverage", false, "coverage,79.5,,higher")
+
+	errCode := Check(CheckOptions{Prefix: "coverage", InputType: "csv"}, strings.NewReader("coverage,79.5,,higher"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	// Improvements move the baseline up.
+	runCheckP(t, "coverage", true, "coverage,81,,higher")
+	runCheckPS(t, "coverage", 1, false, true, "coverage,80.5,,higher")
+
+	checkString(t, "coverage,80.5,81", strings.TrimSpace(runDump(t, "coverage").String()))
+
+	t.Logf("Running check command p: %s s: %g w: %t i: %s", "coverage", 1.0, false, "coverage,79.9,,higher")
+
+	errCode = Check(CheckOptions{Prefix: "coverage", InputType: "csv", Overrides: policy(1, false, false)}, strings.NewReader("coverage,79.9,,higher"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	writeConfig(t, repo, `
+inputType: csv
+slack: 1
+measures:
+  coverage:
+    direction: higher
+    slack: 0.5
+  lint.*:
+    missing: zero
+  lint.errors:
+    slack: 0
+`)
+
+	runCheckConfig(t, true, "coverage,80\nlint.errors,3\nlint.warnings,10")
+
+	// Missing lint measures are zeroed, and lint.warnings gets the top level slack.
+	runCheckConfig(t, true, "coverage,79.5\nlint.warnings,11")
+
+	t.Logf("Running check command with config i: %s", "coverage,79.4")
+
+	errCode := Check(CheckOptions{}, strings.NewReader("coverage,79.4\nlint.warnings,11"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	// Flags on the command line override the config.
+	slack := 1.0
+	errCode = Check(CheckOptions{Overrides: store.MeasureConfig{Slack: &slack}}, strings.NewReader("coverage,79.4\nlint.warnings,11"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	// The config is read from the root of the repository, wherever the check
+	// runs from.
+	sub := filepath.Join(repo, "sub")
+	os.Mkdir(sub, 0755)
+	os.Chdir(sub)
+
+	errCode = Check(CheckOptions{}, strings.NewReader("coverage,80\nlint.errors,0\nlint.warnings,11"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command ignored the config from a subdirectory! Error code: %d", errCode)
+	}
+
+	os.Chdir(repo)
+
+	writeConfig(t, repo, "slak: 1\n")
+
+	errCode = Check(CheckOptions{}, strings.NewReader("coverage,80"))
+
+	if errCode != 10 {
+		t.Fatalf("Check command accepted a bad config!")
+	}
+
+	errCode = Check(CheckOptions{ConfigFile: "missing.yml"}, strings.NewReader("coverage,80"))
+
+	if errCode != 10 {
+		t.Fatalf("Check command accepted a missing config!")
+	}
+}
+
 func TestCheckExcuse(t *testing.T) {
 	if testing.Verbose() {
 		log.SetLogThreshold(log.LevelInfo)
@@ -194,39 +351,1030 @@ func TestCheckExcuse(t *testing.T) {
 
 	repo := createEmptyGitRepo(t)
 
-	runCheckP(t, "foobar", true, "foo,5")
-	// Increase on "barfoo" prefix is okay
-	runCheckP(t, "barfoo", true, "foo,6")
+	runCheckP(t, "foobar", true, "foo,5")
+	// Increase on "barfoo" prefix is okay
+	runCheckP(t, "barfoo", true, "foo,6")
+
+	t.Logf("Running check command p: %s w: %t i: %s", "foobar", false, "foo,6")
+
+	errCode := Check(CheckOptions{Prefix: "foobar", InputType: "csv"}, strings.NewReader("foo,6"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	writeExcuse(t, "foobar", "foo", "PROD's down right now, I'll clean foo up later")
+
+	runCheckP(t, "foobar", true, "foo,6")
+
+	t.Logf("Running check command p: %s w: %t i: %s", "barfoo", false, "foo,7")
+
+	errCode = Check(CheckOptions{Prefix: "barfoo", InputType: "csv"}, strings.NewReader("foo,7"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Third Commit"))
+
+	runCheckP(t, "foobar", true, "foo,6")
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test3.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Fourth Commit"))
+
+	runCheckP(t, "foobar", true, "foo,6")
+}
+
+func TestCheckExcuseMax(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5\nbar,10")
+
+	max := 2.0
+	errCode := Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo,bar", Excuse: "Hotfix", Max: &max})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	// foo rose by more than the excuse allows.
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,8\nbar,12"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, true, "foo,7\nbar,12")
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Second Commit"))
+
+	// The first excuse was used by the check which stored the measures, so
+	// only the second counts.
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Another hotfix", Max: &max})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,10\nbar,12"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, false, "foo,9\nbar,12")
+
+	// Bounded excuses on the same commit add up.
+	one := 1.0
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "A third hotfix", Max: &one})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	runCheck(t, false, "foo,10\nbar,12")
+
+	negative := -1.0
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Backwards", Max: &negative})
+	if errCode != 10 {
+		t.Fatalf("Excuse command accepted a negative maximum!")
+	}
+}
+
+func TestCheckExcuseExpiry(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyDir(t)
+
+	s := store.NewMemoryStore()
+	s.Commit("first")
+
+	check := func(write bool, input string) int {
+		return Check(CheckOptions{Write: write, InputType: "csv", Store: s}, strings.NewReader(input))
+	}
+
+	if errCode := check(true, "foo,5"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("second")
+
+	// An excuse which has already expired doesn't excuse anything.
+	yesterday := time.Now().Add(-24 * time.Hour)
+	err := s.PutExclusion(store.Exclusion{Committer: "Test", Excuse: "Too late", Measure: []string{"foo"}, Expires: &yesterday})
+	if err != nil {
+		t.Fatalf("Failed to write exclusion %s", err)
+	}
+
+	if errCode := check(false, "foo,7"); errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	err = s.PutExclusion(store.Exclusion{Committer: "Test", Excuse: "Hotfix", Measure: []string{"foo"}, ExpiresAfter: 2})
+	if err != nil {
+		t.Fatalf("Failed to write exclusion %s", err)
+	}
+
+	if errCode := check(true, "foo,7"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	next, err := s.CommitMeasures(store.HistoryOptions{})
+	if err != nil {
+		t.Fatalf("Failed to read measures %s", err)
+	}
+	cm, err := next()
+	if err != nil {
+		t.Fatalf("Failed to read measures %s", err)
+	}
+	debt := cm.Measures[0].Debt
+	if debt == nil || debt.Baseline != 5 || debt.Commit != "second" || debt.ExpiresAfter != 2 {
+		t.Fatalf("Unexpected debt stored %+v", debt)
+	}
+
+	s.Commit("third")
+
+	if errCode := check(true, "foo,7"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("fourth")
+
+	// The excuse has expired, so foo has to be back to 5.
+	if errCode := check(false, "foo,7"); errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	if errCode := check(true, "foo,5"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("fifth")
+
+	if errCode := check(false, "foo,6"); errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+}
+
+func TestCheckDebtOnMissingCommit(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyDir(t)
+
+	s := store.NewMemoryStore()
+	s.Commit("first")
+
+	// The commit the excuse was written on has been rebased away.
+	debt := &store.Debt{Baseline: 5, Commit: "gone", ExpiresAfter: 2}
+	stored := []store.Measure{{Name: "aaa", Value: 7, Baseline: 7, Debt: debt}, {Name: "zzz", Value: 10, Baseline: 10}}
+	err := s.PutMeasures(stored, store.RunInfo{})
+	if err != nil {
+		t.Fatalf("Failed to write measures %s", err)
+	}
+
+	s.Commit("second")
+
+	check := func(s store.Store) int {
+		return Check(CheckOptions{Write: true, InputType: "csv", Store: s}, strings.NewReader("aaa,7\nzzz,50"))
+	}
+
+	// The debt can only expire by date, so aaa is still excused and zzz fails.
+	if errCode := check(s); errCode != 50 {
+		t.Fatalf("Check command didn't fail on zzz! Error code: %d", errCode)
+	}
+	if errCode := check(s); errCode != 50 {
+		t.Fatalf("Check command didn't fail on zzz again! Error code: %d", errCode)
+	}
+
+	// When the comparison can't be made, nothing is written.
+	s.Commit("third")
+	if errCode := check(failingCommitsSince{s}); errCode != 40 {
+		t.Fatalf("Check command didn't fail to compare! Error code: %d", errCode)
+	}
+
+	next, err := s.CommitMeasures(store.HistoryOptions{})
+	if err != nil {
+		t.Fatalf("Failed to read measures %s", err)
+	}
+	cm, err := next()
+	if err != nil {
+		t.Fatalf("Failed to read measures %s", err)
+	}
+	if cm.CommitHash != "second" || cm.Measures[1].Baseline != 10 {
+		t.Fatalf("Unexpected measures stored %+v", cm)
+	}
+}
+
+// failingCommitsSince is a store which can't count the commits since any
+// commit.
+type failingCommitsSince struct {
+	*store.MemoryStore
+}
+
+func (s failingCommitsSince) CommitsSince(hash string) (int, error) {
+	return 0, errors.New("Can't walk the history")
+}
+
+func TestCheckExcuseExpiresAfter(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Second Commit"))
+
+	errCode := Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Hotfix", Expires: "next week"})
+	if errCode != 10 {
+		t.Fatalf("Excuse command accepted an invalid date!")
+	}
+
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Hotfix", ExpiresAfter: 1})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	runCheck(t, true, "foo,6")
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test3.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Third Commit"))
+
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,6"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, false, "foo,5")
+}
+
+func TestCommitsSinceMerge(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	commit := func(name string) string {
+		runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, name+".txt").Name()))
+		runCommand(t, repo, exec.Command("git", "commit", "-m", name))
+		hash, err := exec.Command("git", "rev-parse", "HEAD").Output()
+		if err != nil {
+			t.Fatalf("Failed to read HEAD %s", err)
+		}
+		return strings.TrimSpace(string(hash))
+	}
+
+	// The side branch is merged after the main branch moved on, all within
+	// the same second.
+	runCommand(t, repo, exec.Command("git", "branch", "-M", "main"))
+	runCommand(t, repo, exec.Command("git", "branch", "side"))
+	commit("main1")
+	runCommand(t, repo, exec.Command("git", "checkout", "side"))
+	side1 := commit("side1")
+	side2 := commit("side2")
+	runCommand(t, repo, exec.Command("git", "checkout", "main"))
+	runCommand(t, repo, exec.Command("git", "merge", "--no-ff", "-m", "Merge", "side"))
+
+	s := store.NewGitStore("")
+	for hash, expected := range map[string]int{side1: 3, side2: 2} {
+		commits, err := s.CommitsSince(hash)
+		if err != nil {
+			t.Fatalf("Failed to count commits %s", err)
+		}
+		if commits != expected {
+			t.Fatalf("Expected %d commits since %s, got %d", expected, hash, commits)
+		}
+	}
+}
+
+func TestCheckExcusePaidBack(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyDir(t)
+
+	s := store.NewMemoryStore()
+	s.Commit("first")
+
+	check := func(write bool, input string) int {
+		return Check(CheckOptions{Write: write, InputType: "csv", Store: s}, strings.NewReader(input))
+	}
+
+	if errCode := check(true, "foo,5"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("second")
+
+	nextWeek := time.Now().Add(7 * 24 * time.Hour)
+	err := s.PutExclusion(store.Exclusion{Committer: "Test", Excuse: "Hotfix", Measure: []string{"foo"}, Expires: &nextWeek})
+	if err != nil {
+		t.Fatalf("Failed to write exclusion %s", err)
+	}
+
+	if errCode := check(true, "foo,8"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("third")
+
+	// Back under the baseline from before the excuse, so the debt is paid.
+	if errCode := check(true, "foo,4"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	next, err := s.CommitMeasures(store.HistoryOptions{})
+	if err != nil {
+		t.Fatalf("Failed to read measures %s", err)
+	}
+	cm, err := next()
+	if err != nil {
+		t.Fatalf("Failed to read measures %s", err)
+	}
+	if cm.Measures[0].Debt != nil || cm.Measures[0].Baseline != 4 {
+		t.Fatalf("Unexpected measure stored %+v", cm.Measures[0])
+	}
+}
+
+func TestCheckPercentsFromZero(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
+
+	runCheck(t, true, "coverage,0,,higher\nwarnings,0")
+
+	// Coverage improving from nothing is a rise of 100%, and warnings staying
+	// at nothing is no change at all.
+	report := runCheckReport(t, CheckOptions{Overrides: policy(5, true, false)}, "coverage,10,,higher\nwarnings,0", 0)
+
+	coverage, warnings := report.Measures[0], report.Measures[1]
+
+	if coverage.Name != "coverage" || coverage.DeltaPercent != 100 || !coverage.Passed {
+		t.Fatalf("Report incorrect for coverage %+v", coverage)
+	}
+
+	if warnings.Name != "warnings" || warnings.DeltaPercent != 0 || !warnings.Passed {
+		t.Fatalf("Report incorrect for warnings %+v", warnings)
+	}
+
+	// Warnings rising from nothing is still a rise of 100%.
+	report = runCheckReport(t, CheckOptions{Overrides: policy(5, true, false)}, "coverage,0,,higher\nwarnings,1", 50)
+
+	if report.Measures[1].DeltaPercent != 100 || report.Measures[1].Passed {
+		t.Fatalf("Report incorrect for warnings %+v", report.Measures[1])
+	}
+}
+
+func TestCheckMemoryStore(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	// The memory store doesn't need a git repository.
+	createEmptyDir(t)
+
+	s := store.NewMemoryStore()
+	s.Commit("first")
+
+	check := func(input string) int {
+		return Check(CheckOptions{Write: true, InputType: "csv", Store: s}, strings.NewReader(input))
+	}
+
+	if errCode := check("foo,5"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("second")
+
+	if errCode := check("foo,6"); errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	err := s.PutExclusion(store.Exclusion{Committer: "Test", Excuse: "Later", Measure: []string{"foo"}})
+	if err != nil {
+		t.Fatalf("Failed to write exclusion %s", err)
+	}
+
+	if errCode := check("foo,6"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("third")
+
+	if errCode := check("foo,6"); errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	s.Commit("fourth")
+
+	if errCode := check("foo,7"); errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+}
+
+func TestCheckConcurrentWrites(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	const writers = 8
+
+	var wg sync.WaitGroup
+	errCodes := make([]int, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errCodes[i] = Check(CheckOptions{Write: true, InputType: "csv"}, strings.NewReader("foo,5"))
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, errCode := range errCodes {
+		if errCode != 0 {
+			t.Fatalf("Check command failed! Error code: %d", errCode)
+		}
+	}
+
+	// Every writer added a commit to the notes ref, none were lost.
+	output, err := exec.Command("git", "rev-list", "--count", "refs/notes/git-ratchet-2-").Output()
+	if err != nil || strings.TrimSpace(string(output)) != strconv.Itoa(writers) {
+		t.Fatalf("Expected %d notes commits, got %s %s", writers, output, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(repo, ".git-ratchet-note")); !os.IsNotExist(err) {
+		t.Fatalf("Note written to the working tree")
+	}
+}
+
+func TestCheckPush(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+	remote := repo + ".git"
+	other := repo + "-other"
+
+	runCommand(t, repo, exec.Command("git", "clone", "--bare", repo, remote))
+	runCommand(t, repo, exec.Command("git", "remote", "add", "origin", remote))
+	runCommand(t, repo, exec.Command("git", "clone", remote, other))
+
+	// Until the notes have been fetched, nothing is written over them.
+	errCode := Check(CheckOptions{Write: true, Push: true, InputType: "csv"}, strings.NewReader("foo,5"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	err := exec.Command("git", "notes", "--ref=git-ratchet-2-", "show", "HEAD").Run()
+	if err == nil {
+		t.Fatalf("Measures written without fetching the notes")
+	}
+
+	errCode = Check(CheckOptions{Write: true, Fetch: true, InputType: "csv"}, strings.NewReader("foo,5"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	// Another build checks the same commit and pushes first, so this push is
+	// rejected until the notes are merged.
+	os.Chdir(other)
+	runCommand(t, other, exec.Command("git", "config", "user.name", "Other Name"))
+
+	errCode = Check(CheckOptions{Write: true, Push: true, Fetch: true, InputType: "csv"}, strings.NewReader("foo,4\nbar,2"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	os.Chdir(repo)
+
+	errCode = Check(CheckOptions{Write: true, Push: true, InputType: "csv"}, strings.NewReader("foo,5"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	output, err := exec.Command("git", "--git-dir", remote, "notes", "--ref=git-ratchet-2-", "show", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Failed to read pushed note %s", err)
+	}
+
+	note, err := store.ParseNote(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("Failed to parse note %s", err)
+	}
+
+	measures := note.StoredMeasures()
+	if len(measures) != 2 || measures[0].Name != "bar" || measures[1].Name != "foo" || measures[1].Baseline != 4 {
+		t.Fatalf("Notes not merged, got %s", output)
+	}
+}
+
+func TestMergeMeasureNotes(t *testing.T) {
+	write := func(measures []store.Measure, excuses ...string) string {
+		note := store.NewNote(measures, store.RunInfo{})
+		note.Excuses = excuses
+
+		var b bytes.Buffer
+		err := store.WriteNote(note, &b)
+		if err != nil {
+			t.Fatalf("Failed to write note %s", err)
+		}
+		return b.String()
+	}
+
+	ours := write([]store.Measure{{Name: "foo", Value: 5, Baseline: 5}}, "a", "b")
+	theirs := write([]store.Measure{{Name: "foo", Value: 4, Baseline: 4}}, "b", "c")
+
+	merged, err := store.MergeMeasureNotes(ours, theirs)
+	if err != nil {
+		t.Fatalf("Failed to merge notes %s", err)
+	}
+
+	note, err := store.ParseNote(strings.NewReader(merged))
+	if err != nil {
+		t.Fatalf("Failed to parse note %s", err)
+	}
+
+	// The excuses used by either note stay used.
+	if strings.Join(note.Excuses, ",") != "a,b,c" || note.StoredMeasures()[0].Baseline != 4 {
+		t.Fatalf("Notes not merged, got %s", merged)
+	}
+}
+
+func TestCheckRequireBaseline(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+	shallow := repo + "-shallow"
+
+	runCommand(t, repo, exec.Command("git", "clone", "--bare", repo, repo+".git"))
+	runCommand(t, repo, exec.Command("git", "remote", "add", "origin", repo+".git"))
+
+	checkBaseline := func(expected int) {
+		errCode := Check(CheckOptions{RequireBaseline: true, InputType: "csv"}, strings.NewReader("foo,6"))
+
+		if errCode != expected {
+			t.Fatalf("Expected error code %d, got %d", expected, errCode)
+		}
+	}
+
+	// Nothing is written over measures which may not have been fetched.
+	notWritten := func() {
+		err := exec.Command("git", "notes", "--ref=git-ratchet-2-", "show", "HEAD").Run()
+		if err == nil {
+			t.Fatalf("Measures written over ones which couldn't be read")
+		}
+	}
+
+	// No notes have been written or fetched.
+	checkBaseline(80)
+	runCheck(t, true, "foo,6")
+	notWritten()
+
+	// The notes exist, but there's nothing stored in the history, so this is
+	// the first run.
+	runCommand(t, repo, exec.Command("git", "notes", "--ref=git-ratchet-1-", "add", "-m", "foo,5,5", "HEAD^{tree}"))
+	checkBaseline(0)
+
+	runCommand(t, repo, exec.Command("git", "notes", "--ref=git-ratchet-1-", "add", "-m", "foo,5,5", "HEAD^"))
+	checkBaseline(50)
+
+	// The commit with the stored measures is beyond the shallow clone.
+	runCommand(t, repo, exec.Command("git", "clone", "--depth", "1", "file://"+repo, shallow))
+	os.Chdir(shallow)
+	runCommand(t, shallow, exec.Command("git", "fetch", "origin", "refs/notes/*:refs/notes/*"))
+
+	checkBaseline(80)
+	runCheck(t, true, "foo,6")
+	notWritten()
+}
+
+func TestCheckBase(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCommand(t, repo, exec.Command("git", "branch", "-M", "target"))
+	runCheck(t, true, "foo,5")
+
+	// The feature branch stores its own measures.
+	runCommand(t, repo, exec.Command("git", "checkout", "-b", "feature"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "feature.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Feature Commit"))
+	runCheck(t, true, "foo,3")
+
+	// The target branch moves on after the feature branched off.
+	runCommand(t, repo, exec.Command("git", "checkout", "target"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "target.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Target Commit"))
+	runCheck(t, true, "foo,4")
+
+	runCommand(t, repo, exec.Command("git", "checkout", "feature"))
+
+	errCode := Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,4.5"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	// Compared against the merge-base with the target branch.
+	errCode = Check(CheckOptions{Base: "target", InputType: "csv"}, strings.NewReader("foo,4.5"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	errCode = Check(CheckOptions{Base: "target", InputType: "csv"}, strings.NewReader("foo,6"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	errCode = Check(CheckOptions{Base: "missing", InputType: "csv"}, strings.NewReader("foo,4"))
+
+	if errCode != 20 {
+		t.Fatalf("Check command accepted a missing base!")
+	}
+}
+
+func TestCheckBaseMergedBranch(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCommand(t, repo, exec.Command("git", "branch", "-M", "target"))
+	runCheck(t, true, "foo,5")
+
+	// A side branch stores its own measures, and the feature branches off it.
+	runCommand(t, repo, exec.Command("git", "checkout", "-b", "side"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "side.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Side Commit"))
+	runCheck(t, true, "foo,3")
+
+	runCommand(t, repo, exec.Command("git", "checkout", "-b", "feature"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "feature.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Feature Commit"))
+
+	// The side branch is merged into the target, making its commit the
+	// merge-base of the feature and the target.
+	runCommand(t, repo, exec.Command("git", "checkout", "target"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "target.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Target Commit"))
+	runCommand(t, repo, exec.Command("git", "merge", "--no-ff", "-m", "Merge side", "side"))
+
+	runCommand(t, repo, exec.Command("git", "checkout", "feature"))
+
+	// Compared against the target's own history, not the side branch.
+	errCode := Check(CheckOptions{Base: "target", InputType: "csv"}, strings.NewReader("foo,4.5"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	errCode = Check(CheckOptions{Base: "target", InputType: "csv"}, strings.NewReader("foo,6"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+}
+
+func TestCheckNoteFormat(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	writeConfig(t, repo, `
+measures:
+  foo:
+    unit: ms
+    slack: 1
+`)
+
+	// Version 1 notes are still read.
+	runCommand(t, repo, exec.Command("git", "notes", "--ref=git-ratchet-1-", "add", "-m", "foo,5,5"))
+
+	errCode := Check(CheckOptions{Write: true}, strings.NewReader("foo,7"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheckConfig(t, true, "foo,6")
+
+	output, err := exec.Command("git", "notes", "--ref=git-ratchet-2-", "show", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Failed to read note %s", err)
+	}
+
+	note, err := store.ParseNote(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("Failed to parse note %s", err)
+	}
+
+	if note.Version != 2 || note.InputType != "csv" || len(note.Measures) != 1 {
+		t.Fatalf("Unexpected note %s", output)
+	}
+
+	m := note.Measures[0]
+	if m.Name != "foo" || m.Value != 6 || m.Unit != "ms" || m.Slack != 1 {
+		t.Fatalf("Unexpected measure in note %s", output)
+	}
+
+	errCode = Check(CheckOptions{}, strings.NewReader("foo,7.5"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	// Notes written by a later version of git-ratchet aren't misread.
+	runCommand(t, repo, exec.Command("git", "notes", "--ref=git-ratchet-2-", "add", "-f", "-m",
+		`{"version":3,"timestamp":"2020-01-01T00:00:00Z","measures":[{"name":"foo","value":6}]}`))
+
+	errCode = Check(CheckOptions{}, strings.NewReader("foo,6"))
+
+	if errCode == 0 {
+		t.Fatalf("Check command read an unsupported note version!")
+	}
+}
+
+func TestCheckAfterGC(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
+
+	// git gc moves the notes ref into packed-refs.
+	runCommand(t, repo, exec.Command("git", "gc", "-q"))
+
+	runCommand(t, repo, exec.Command("git", "commit", "--allow-empty", "-m", "Third Commit"))
+	runCheck(t, true, "foo,4")
+
+	dump := runDump(t, "").String()
+	if !strings.Contains(dump, "foo,4,4") || !strings.Contains(dump, "foo,5,5") {
+		t.Fatalf("Dump incorrect. Expected both checks in %s", dump)
+	}
+}
+
+func TestCheckKeepsOtherNotesEntries(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
 
-	t.Logf("Running check command p: %s w: %t i: %s", "foobar", false, "foo,6")
+	// Put a file which isn't a note into the notes tree, as other tools may.
+	script := `blob=$(echo hello | git hash-object -w --stdin) &&
+GIT_INDEX_FILE=.git/notes-index git read-tree refs/notes/git-ratchet-2- &&
+GIT_INDEX_FILE=.git/notes-index git update-index --add --cacheinfo 100644,$blob,README &&
+tree=$(GIT_INDEX_FILE=.git/notes-index git write-tree) &&
+git update-ref refs/notes/git-ratchet-2- $(git commit-tree $tree -p refs/notes/git-ratchet-2- -m README)`
+	runCommand(t, repo, exec.Command("sh", "-c", script))
+
+	runCommand(t, repo, exec.Command("git", "commit", "--allow-empty", "-m", "Third Commit"))
+	runCheck(t, true, "foo,4")
+
+	if err := exec.Command("git", "cat-file", "-e", "refs/notes/git-ratchet-2-:README").Run(); err != nil {
+		t.Fatalf("Writing notes dropped the README from the notes tree")
+	}
+
+	dump := runDump(t, "").String()
+	if !strings.Contains(dump, "foo,4,4") || !strings.Contains(dump, "foo,5,5") {
+		t.Fatalf("Dump incorrect. Expected both checks in %s", dump)
+	}
+}
+
+func TestCheckDirStore(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
 
-	errCode := Check("foobar", 0, false, false, "csv", false, strings.NewReader("foo,6"))
+	writeConfig(t, repo, `
+store:
+  type: dir
+  path: ratchet
+`)
+
+	runCheckConfig(t, true, "foo,5")
+
+	errCode := Check(CheckOptions{}, strings.NewReader("foo,6"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
 	}
 
-	writeExcuse(t, "foobar", "foo", "PROD's down right now, I'll clean foo up later")
+	files, err := filepath.Glob(filepath.Join(repo, "ratchet", "measures", "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one measures file, found %s", files)
+	}
 
-	runCheckP(t, "foobar", true, "foo,6")
+	// The path is relative to the root of the worktree, not the directory
+	// the check runs in.
+	sub := filepath.Join(repo, "sub")
+	os.Mkdir(sub, 0755)
+	os.Chdir(sub)
 
-	t.Logf("Running check command p: %s w: %t i: %s", "barfoo", false, "foo,7")
+	errCode = Check(CheckOptions{}, strings.NewReader("foo,6"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command didn't read the dir store from a subdirectory!")
+	}
+
+	os.Chdir(repo)
+
+	writeExcuse(t, "", "foo", "Later")
+
+	runCheckConfig(t, true, "foo,6")
+
+	buf := runDump(t, "")
+
+	if !strings.Contains(buf.String(), ",foo,6,6") {
+		t.Fatalf("Dump didn't read the dir store, got %s", buf.String())
+	}
+}
+
+func TestCheckJSONReport(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
+
+	report := runCheckReport(t, CheckOptions{Prefix: "report", Write: true}, "foo,5\nbar,3", 0)
+
+	if !report.Passed || len(report.Measures) != 2 || !report.Measures[0].New {
+		t.Fatalf("Report incorrect for first run %+v", report)
+	}
+
+	writeExcuse(t, "report", "foo", "Report test")
+
+	report = runCheckReport(t, CheckOptions{Prefix: "report", Overrides: policy(0.5, false, false)}, "foo,6\nbar,2\nbaz,1", 0)
+
+	if !report.Passed || report.BaselineCommit == "" || report.BaselineCommitter != "test@example.com" {
+		t.Fatalf("Report incorrect %+v", report)
+	}
+
+	bar, baz, foo := report.Measures[0], report.Measures[1], report.Measures[2]
+
+	if bar.Name != "bar" || bar.Baseline != 3 || bar.Value != 2 || bar.Delta != -1 || !bar.Passed || bar.Excused {
+		t.Fatalf("Report incorrect for bar %+v", bar)
+	}
+
+	if baz.Name != "baz" || !baz.New || !baz.Passed {
+		t.Fatalf("Report incorrect for baz %+v", baz)
+	}
+
+	if foo.Name != "foo" || foo.Delta != 1 || foo.DeltaPercent != 20 || foo.Slack != 0.5 || !foo.Excused || !foo.Passed {
+		t.Fatalf("Report incorrect for foo %+v", foo)
+	}
+
+	report = runCheckReport(t, CheckOptions{Prefix: "report"}, "bar,4", 50)
+
+	if report.Passed || report.Measures[0].Passed || !report.Measures[1].Missing || report.Measures[1].Passed {
+		t.Fatalf("Report incorrect for failing run %+v", report)
+	}
+}
+
+func TestCheckAnnotations(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
 
-	errCode = Check("barfoo", 0, false, false, "csv", false, strings.NewReader("foo,7"))
+	runCheckP(t, "annotations", true, "bar,2\nfoo,5")
+
+	t.Logf("Running check command p: %s f: %s i: %s", "annotations", "github", "foo,7")
+
+	buf := new(bytes.Buffer)
+	errCode := Check(CheckOptions{Prefix: "annotations", InputType: "csv", Format: "github", Output: buf}, strings.NewReader("foo,7"))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
 	}
 
-	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
-	runCommand(t, repo, exec.Command("git", "commit", "-m", "Third Commit"))
+	expected := "::error title=Measure missing%3A bar::bar was not measured, its baseline is 2.\n" +
+		"::error title=Measure rising%3A foo::foo rose from 5 to 7 (+2, +40%25), the slack is 0.\n"
 
-	runCheckP(t, "foobar", true, "foo,6")
+	if buf.String() != expected {
+		t.Fatalf("Annotations incorrect. Expected %s got %s", expected, buf.String())
+	}
 
-	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test3.txt").Name()))
-	runCommand(t, repo, exec.Command("git", "commit", "-m", "Fourth Commit"))
+	t.Logf("Running check command p: %s f: %s i: %s", "annotations", "gitlab", "foo,7")
 
-	runCheckP(t, "foobar", true, "foo,6")
+	buf.Reset()
+	errCode = Check(CheckOptions{Prefix: "annotations", InputType: "csv", Format: "gitlab", Output: buf}, strings.NewReader("bar,2\nfoo,7"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	var issues []gitLabIssue
+	err := json.Unmarshal(buf.Bytes(), &issues)
+
+	if err != nil {
+		t.Fatalf("Failed to read code quality report %s: %s", err, buf.String())
+	}
+
+	if len(issues) != 1 || issues[0].Severity != "major" || issues[0].Location.Path != ".git-ratchet.yml" || len(issues[0].Fingerprint) != 32 {
+		t.Fatalf("Code quality report incorrect %+v", issues)
+	}
+
+	errCode = Check(CheckOptions{Prefix: "annotations", InputType: "csv", Format: "teamcity"}, strings.NewReader("foo,5"))
+
+	if errCode != 10 {
+		t.Fatalf("Check command accepted an unknown format!")
+	}
+}
+
+func TestCheckMarkdownReport(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
+
+	runCheckP(t, "markdown", true, "bar,2\nfoo,5")
+
+	writeExcuse(t, "markdown", "foo", "Markdown test")
+
+	t.Logf("Running check command p: %s f: %s i: %s", "markdown", "markdown", "bar,1\nbaz,3\nfoo,7")
+
+	buf := new(bytes.Buffer)
+	errCode := Check(CheckOptions{Prefix: "markdown", InputType: "csv", Format: "markdown", Output: buf}, strings.NewReader("bar,1\nbaz,3\nfoo,7"))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+
+	checkString(t, "### git-ratchet (markdown): passing", lines[0])
+
+	if !strings.HasSuffix(lines[2], ", measured by test@example.com.") {
+		t.Fatalf("Report incorrect. Expected committer in %s", lines[2])
+	}
+
+	for i, expected := range []string{
+		"| bar | 2 → 1 | -1 (-50%) | :white_check_mark: passing | no |",
+		"| baz | – → 3 | – | :new: new | no |",
+		"| foo | 5 → 7 | +2 (+40%) | :white_check_mark: passing | yes |",
+	} {
+		checkString(t, expected, lines[6+i])
+	}
 }
 
 func TestCheckWithCheckstyleInput(t *testing.T) {
@@ -243,7 +1391,7 @@ func TestCheckWithCheckstyleInput(t *testing.T) {
 
 	t.Logf("Running check command p: %s w: %t i: %s", "jshint", true, checkStyleFile)
 
-	errCode := Check("jshint", 0, false, true, "checkstyle", false, checkStyleFile)
+	errCode := Check(CheckOptions{Prefix: "jshint", Write: true, InputType: "checkstyle"}, checkStyleFile)
 
 	if errCode != 0 {
 		t.Fatalf("Check command failed! Error code: %d", errCode)
@@ -251,7 +1399,174 @@ func TestCheckWithCheckstyleInput(t *testing.T) {
 
 	t.Logf("Running check command p: %s w: %t i: %s", "jshint", false, "errors,951")
 
-	errCode = Check("jshint", 0, false, false, "csv", false, strings.NewReader("errors,951"))
+	errCode = Check(CheckOptions{Prefix: "jshint", InputType: "csv"}, strings.NewReader("errors,951"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+}
+
+func TestCheckWithCheckstyleGroups(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	if checkStyleFileErr != nil {
+		t.Fatalf("Failure opening test data %s", checkStyleFileErr)
+	}
+
+	checkStyleFile.Seek(0, 0)
+
+	createEmptyGitRepo(t)
+
+	t.Logf("Running check command p: %s w: %t i: %s", "jshint", true, checkStyleFile.Name())
+
+	errCode := Check(CheckOptions{Prefix: "jshint", Write: true, InputType: "checkstyle", GroupBy: []string{"severity", "source", "dir=2"}}, checkStyleFile)
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	dump := runDump(t, "jshint").String()
+
+	for _, expected := range []string{"errors,950,950", "errors.severity.warning,946,946", "errors.severity.error,2,2",
+		"errors.source.jshint.W033,86,86", "errors.dir./Users/ian,950,950"} {
+		if !strings.Contains(dump, expected) {
+			t.Fatalf("Dump incorrect. Expected %s in %s", expected, dump)
+		}
+	}
+
+	// Trading warnings for errors keeps the total the same, but still fails.
+	input := "errors,950\nerrors.severity.error,3\nerrors.severity.info,2\nerrors.severity.warning,945\n" +
+		"errors.source.jshint.W033,86\nerrors.dir./Users/ian,950"
+
+	t.Logf("Running check command p: %s w: %t i: %s", "jshint", false, input)
+
+	errCode = Check(CheckOptions{Prefix: "jshint", InputType: "csv", Overrides: policy(0, false, true)}, strings.NewReader(input))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	t.Logf("Running check command p: %s w: %t i: %s g: %s", "jshint", false, "", "line")
+
+	errCode = Check(CheckOptions{Prefix: "jshint", InputType: "checkstyle", GroupBy: []string{"line"}}, strings.NewReader(""))
+
+	if errCode != 10 {
+		t.Fatalf("Check command accepted an unknown group!")
+	}
+}
+
+func TestCheckCheckstyleFromSubdirectory(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	sub := filepath.Join(repo, "src")
+	os.Mkdir(sub, 0755)
+	os.Chdir(sub)
+
+	input := `<checkstyle><file name="` + filepath.Join(sub, "app.js") + `"><error severity="warning"/></file></checkstyle>`
+
+	t.Logf("Running check command p: %s w: %t i: %s", "jshint", true, input)
+
+	errCode := Check(CheckOptions{Prefix: "jshint", Write: true, InputType: "checkstyle", GroupBy: []string{"file"}}, strings.NewReader(input))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	// Paths are relative to the root of the repository, not the directory
+	// the check ran from.
+	dump := runDump(t, "jshint").String()
+
+	if !strings.Contains(dump, "errors.file.src/app.js,1,1") {
+		t.Fatalf("Dump incorrect. Expected errors.file.src/app.js in %s", dump)
+	}
+}
+
+func TestCheckWithJUnitInput(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	if junitFileErr != nil {
+		t.Fatalf("Failure opening test data %s", junitFileErr)
+	}
+
+	createEmptyGitRepo(t)
+
+	t.Logf("Running check command p: %s w: %t i: %s", "tests", true, "junit.xml")
+
+	errCode := Check(CheckOptions{Prefix: "tests", Write: true, InputType: "junit", GroupBy: []string{"suite"}}, junitFile)
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	dump := runDump(t, "tests").String()
+
+	for _, expected := range []string{"tests.failures,2,2", "tests.errors,1,1", "tests.skipped,1,1", "tests.toolbar.failures,1,1", "tests.editor.skipped,1,1",
+		"tests.total,6,6", "tests.editor.total,4,4"} {
+		if !strings.Contains(dump, expected) {
+			t.Fatalf("Dump incorrect. Expected %s in %s", expected, dump)
+		}
+	}
+
+	t.Logf("Running check command p: %s w: %t i: %s", "tests", false, "tests.skipped,2")
+
+	errCode = Check(CheckOptions{Prefix: "tests", InputType: "csv", Overrides: policy(0, false, true)}, strings.NewReader("tests.skipped,2"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+}
+
+func TestCheckWithSARIFInput(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	if sarifFileErr != nil {
+		t.Fatalf("Failure opening test data %s", sarifFileErr)
+	}
+
+	createEmptyGitRepo(t)
+
+	t.Logf("Running check command p: %s w: %t i: %s", "sarif", true, "results.sarif")
+
+	errCode := Check(CheckOptions{Prefix: "sarif", Write: true, InputType: "sarif"}, sarifFile)
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+
+	dump := runDump(t, "sarif").String()
+
+	for _, expected := range []string{"sarif.total,5,5", "sarif.level.error,2,2", "sarif.level.warning,2,2", "sarif.level.note,1,1",
+		"sarif.rule.G101,1,1", "sarif.rule.G104,3,3", "sarif.rule.go.lang.security.audit.xss,1,1"} {
+		if !strings.Contains(dump, expected) {
+			t.Fatalf("Dump incorrect. Expected %s in %s", expected, dump)
+		}
+	}
+
+	if strings.Contains(dump, "sarif.level.none") {
+		t.Fatalf("Dump incorrect. Didn't expect sarif.level.none in %s", dump)
+	}
+
+	// One rule rising fails the check even when the total doesn't change.
+	input := "sarif.total,5\nsarif.level.error,2\nsarif.level.warning,2\nsarif.level.note,1\n" +
+		"sarif.rule.G101,2\nsarif.rule.G104,2\nsarif.rule.go.lang.security.audit.xss,1"
+
+	t.Logf("Running check command p: %s w: %t i: %s", "sarif", false, input)
+
+	errCode = Check(CheckOptions{Prefix: "sarif", InputType: "csv"}, strings.NewReader(input))
 
 	if errCode != 50 {
 		t.Fatalf("Check command passed unexpectedly!")
@@ -261,7 +1576,7 @@ func TestCheckWithCheckstyleInput(t *testing.T) {
 func writeExcuse(t *testing.T, prefix string, measure string, excuse string) {
 	t.Logf("Running excuse command p: %s m: %s, e: %s", prefix, measure, excuse)
 
-	errCode := Excuse(prefix, measure, excuse)
+	errCode := Excuse(CheckOptions{Prefix: prefix}, ExcuseOptions{Measure: measure, Excuse: excuse})
 
 	if errCode != 0 {
 		t.Fatalf("Excuse command failed! Error code: %d", errCode)
@@ -279,13 +1594,79 @@ func runCheckP(t *testing.T, prefix string, write bool, input string) {
 func runCheckPS(t *testing.T, prefix string, slack float64, usePercents bool, write bool, input string) {
 	t.Logf("Running check command p: %s s: %g, sp: %t, w: %t i: %s", prefix, slack, usePercents, write, input)
 
-	errCode := Check(prefix, slack, usePercents, write, "csv", false, strings.NewReader(input))
+	errCode := Check(CheckOptions{Prefix: prefix, Write: write, InputType: "csv", Overrides: policy(slack, usePercents, false)}, strings.NewReader(input))
+
+	if errCode != 0 {
+		t.Fatalf("Check command failed! Error code: %d", errCode)
+	}
+}
+
+func runCheckReport(t *testing.T, opts CheckOptions, input string, expected int) Report {
+	t.Logf("Running check command p: %s f: %s i: %s", opts.Prefix, "json", input)
+
+	buf := new(bytes.Buffer)
+	opts.InputType = "csv"
+	opts.Format = "json"
+	opts.Output = buf
+
+	errCode := Check(opts, strings.NewReader(input))
+
+	if errCode != expected {
+		t.Fatalf("Check command returned error code %d, expected %d", errCode, expected)
+	}
+
+	var report Report
+	err := json.Unmarshal(buf.Bytes(), &report)
+
+	if err != nil {
+		t.Fatalf("Failed to read report %s: %s", err, buf.String())
+	}
+
+	return report
+}
+
+func runCheckConfig(t *testing.T, write bool, input string) {
+	t.Logf("Running check command with config w: %t i: %s", write, input)
+
+	errCode := Check(CheckOptions{Write: write}, strings.NewReader(input))
 
 	if errCode != 0 {
 		t.Fatalf("Check command failed! Error code: %d", errCode)
 	}
 }
 
+func writeConfig(t *testing.T, repo string, config string) {
+	err := ioutil.WriteFile(filepath.Join(repo, store.DefaultConfigFile), []byte(config), 0644)
+
+	if err != nil {
+		t.Fatalf("Failed to write config %s", err)
+	}
+}
+
+func policy(slack float64, usePercents bool, zeroOnMissing bool) store.MeasureConfig {
+	missing := store.MissingFail
+	if zeroOnMissing {
+		missing = store.MissingZero
+	}
+	return store.MeasureConfig{Slack: &slack, UsePercents: &usePercents, Missing: &missing}
+}
+
+func createEmptyDir(t *testing.T) string {
+	dir, err := ioutil.TempDir(os.TempDir(), "git-ratchet-test-")
+
+	if err != nil {
+		t.Fatalf("Failed to create directory %s", dir)
+	}
+
+	err = os.Chdir(dir)
+
+	if err != nil {
+		t.Fatalf("Failed to change to directory %s", dir)
+	}
+
+	return dir
+}
+
 func createEmptyGitRepo(t *testing.T) string {
 	repo, err := ioutil.TempDir(os.TempDir(), "git-ratchet-test-")
 
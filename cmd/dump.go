@@ -5,14 +5,25 @@ import (
 	"github.com/iangrunert/git-ratchet/store"
 	log "github.com/spf13/jwalterweatherman"
 	"io"
-	"strconv"
 )
 
-func Dump(prefix string, output io.Writer) int {
-	log.INFO.Println("Reading measures stored in git")
-	gitlog := store.CommitMeasureCommand(prefix)
+// Dump writes every stored measure to output as CSV, most recent first. Only
+// the Prefix, ConfigFile, AllParents and Store options are used.
+func Dump(opts CheckOptions, output io.Writer) int {
+	config, err := loadConfig(opts)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
 
-	readStoredMeasure, err := store.CommitMeasures(gitlog)
+	s, err := openStore(opts, config)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 20
+	}
+
+	log.INFO.Println("Reading stored measures")
+	readStoredMeasure, err := s.CommitMeasures(historyOptions(opts))
 	if err != nil {
 		log.FATAL.Println(err)
 		return 20
@@ -24,6 +35,9 @@ func Dump(prefix string, output io.Writer) int {
 		// Empty state of the repository - no stored metrics.
 		if err == io.EOF {
 			break
+		} else if err == store.ErrNoNotes || err == store.ErrShallowHistory {
+			log.WARN.Println(err)
+			break
 		} else if err != nil {
 			log.FATAL.Println(err)
 			return 40
@@ -32,11 +46,11 @@ func Dump(prefix string, output io.Writer) int {
 		out := csv.NewWriter(output)
 
 		for _, measure := range cm.Measures {
-			out.Write([]string{cm.Timestamp.String(), measure.Name, strconv.Itoa(measure.Value), strconv.Itoa(measure.Baseline)})
+			out.Write([]string{cm.Timestamp.String(), measure.Name, store.FormatValue(measure.Value), store.FormatValue(measure.Baseline)})
 		}
 		out.Flush()
 	}
 
-	log.INFO.Println("Finished reading measures stored in git")
+	log.INFO.Println("Finished reading stored measures")
 	return 0
 }
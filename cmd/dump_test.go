@@ -3,6 +3,7 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"os"
 	"os/exec"
 	"strings"
 	"testing"
@@ -40,6 +41,48 @@ func TestDump(t *testing.T) {
 	}
 }
 
+func TestDumpFirstParent(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
+
+	// Measures stored on a branch which is merged back in.
+	runCommand(t, repo, exec.Command("git", "checkout", "-b", "side"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "side.txt").Name()))
+	commit := exec.Command("git", "commit", "-m", "Side Commit")
+	commit.Env = append(os.Environ(), "GIT_COMMITTER_DATE=2090-01-01T00:00:00Z")
+	runCommand(t, repo, commit)
+	runCheck(t, true, "foo,3")
+
+	runCommand(t, repo, exec.Command("git", "checkout", "-"))
+	runCommand(t, repo, exec.Command("git", "merge", "--no-ff", "-m", "Merge Commit", "side"))
+
+	dump := strings.Split(strings.TrimSpace(runDumpOpts(t, CheckOptions{AllParents: true}).String()), "\n")
+
+	if len(dump) != 2 {
+		t.Fatalf("Expected both measures, got %s", dump)
+	}
+
+	checkString(t, "foo,3,3", dump[0])
+	checkString(t, "foo,5,5", dump[1])
+
+	checkString(t, "foo,5,5", strings.TrimSpace(runDumpOpts(t, CheckOptions{}).String()))
+
+	// Check only follows the mainline by default.
+	runCheck(t, false, "foo,4")
+
+	errCode := Check(CheckOptions{AllParents: true, InputType: "csv"}, strings.NewReader("foo,4"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+}
+
 func checkString(t *testing.T, expected string, actual string) {
 	if !strings.HasSuffix(actual, expected) {
 		t.Fatalf("Dump incorrect. Expected suffix %s got %s", expected, actual)
@@ -47,11 +90,15 @@ func checkString(t *testing.T, expected string, actual string) {
 }
 
 func runDump(t *testing.T, prefix string) *bytes.Buffer {
+	return runDumpOpts(t, CheckOptions{Prefix: prefix})
+}
+
+func runDumpOpts(t *testing.T, opts CheckOptions) *bytes.Buffer {
 	t.Logf("Running dump command")
 
 	buf := new(bytes.Buffer)
 
-	errCode := Dump(prefix, buf)
+	errCode := Dump(opts, buf)
 
 	if errCode != 0 {
 		t.Fatalf("Dump command failed! Error code: %d", errCode)
@@ -1,12 +1,56 @@
 package cmd
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/iangrunert/git-ratchet/store"
 	log "github.com/spf13/jwalterweatherman"
+	"io"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
-func Excuse(prefix string, measure string, excuse string) int {
+// ExcuseOptions describes the exclusion written by Excuse.
+type ExcuseOptions struct {
+	// Measure is the names of the measures to excuse, comma separated.
+	Measure string
+	Excuse  string
+	// Max bounds how far each measure may move in the wrong direction. Without
+	// it, any change is excused.
+	Max *float64
+	// Expires is the date the raised baseline lapses, as 2006-01-02 or RFC
+	// 3339, and ExpiresAfter the number of commits after which it does.
+	Expires      string
+	ExpiresAfter int
+	// NoMax and NoExpiry drop the maximum and the expiry when amending.
+	NoMax    bool
+	NoExpiry bool
+	// Commit names the commit to write the excuse on, in place of HEAD, and
+	// Range the commits, as from..to like git log. The excuse is read by
+	// checks of any commit it's written on, or after. Both are ignored when
+	// amending.
+	Commit string
+	Range  string
+}
+
+// Excuse writes an exclusion for the measures on HEAD, or the commits given,
+// and pushes it. Only the Prefix, ConfigFile, Remote and Store options are
+// used.
+func Excuse(opts CheckOptions, ex ExcuseOptions) int {
+	config, err := loadConfig(opts)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	s, err := openStore(opts, config)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
 	name, err := store.GetCommitterName()
 
 	if err != nil {
@@ -15,14 +59,666 @@ func Excuse(prefix string, measure string, excuse string) int {
 		return 10
 	}
 
-	exclusion := store.Exclusion{Committer: name, Excuse: excuse, Measure: strings.Split(measure, ",")}
+	exclusion := store.Exclusion{Committer: name, Measure: strings.Split(ex.Measure, ",")}
 
-	err = store.WriteExclusion(prefix, exclusion)
+	err = applyExcuse(&exclusion, ex)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	switch {
+	case ex.Commit != "" && ex.Range != "":
+		log.FATAL.Println("Excuse either a commit or a range of commits, not both")
+		return 10
+	case ex.Commit != "":
+		commit, rerr := store.ResolveCommit(ex.Commit)
+		if rerr != nil {
+			log.FATAL.Printf("Error resolving %s: %s", ex.Commit, rerr)
+			return 10
+		}
+		err = s.UpdateExclusions([]string{commit}, store.AppendExclusion(exclusion))
+	case ex.Range != "":
+		commits, resolved, rerr := store.ResolveRange(ex.Range)
+		if rerr != nil {
+			log.FATAL.Println(rerr)
+			return 10
+		}
+		exclusion.Range = resolved
+		err = s.UpdateExclusions(commits, store.AppendExclusion(exclusion))
+	default:
+		err = s.PutExclusion(exclusion)
+	}
 
 	if err != nil {
 		log.FATAL.Println("Error writing exclusion note %s", err)
 		return 20
 	}
 
+	err = s.Push()
+
+	if err != nil {
+		log.FATAL.Printf("Error while pushing notes: %s", err)
+		return 70
+	}
+
+	return 0
+}
+
+// applyExcuse sets the fields of the exclusion given in the options, apart from
+// the measures.
+func applyExcuse(exclusion *store.Exclusion, ex ExcuseOptions) error {
+	if ex.Max != nil && *ex.Max < 0 {
+		return errors.New("The maximum excused delta can't be negative")
+	}
+
+	if ex.ExpiresAfter < 0 {
+		return errors.New("The number of commits an excuse expires after can't be negative")
+	}
+
+	if ex.NoMax && ex.Max != nil {
+		return errors.New("Give either a new maximum or drop it, not both")
+	}
+
+	if ex.NoExpiry && (ex.Expires != "" || ex.ExpiresAfter > 0) {
+		return errors.New("Give either a new expiry or drop it, not both")
+	}
+
+	if ex.NoMax {
+		exclusion.Max = nil
+	}
+	if ex.NoExpiry {
+		exclusion.Expires = nil
+		exclusion.ExpiresAfter = 0
+	}
+
+	if ex.Excuse != "" {
+		exclusion.Excuse = ex.Excuse
+	}
+	if ex.Max != nil {
+		exclusion.Max = ex.Max
+	}
+	if ex.ExpiresAfter > 0 {
+		exclusion.ExpiresAfter = ex.ExpiresAfter
+	}
+
+	if ex.Expires != "" {
+		expires, err := parseDate(ex.Expires)
+		if err != nil {
+			return fmt.Errorf("Invalid expiry date %s, expected 2006-01-02 or RFC 3339", ex.Expires)
+		}
+		exclusion.Expires = &expires
+	}
+
+	return nil
+}
+
+// ExcuseSelector picks the excuses on a commit to revoke or amend.
+type ExcuseSelector struct {
+	// Commit names the commit the excuses were written on, HEAD by default.
+	Commit string
+	// Measure picks the excuses for the named measure, of several on the
+	// commit.
+	Measure string
+}
+
+// RevokeExcuse withdraws the selected excuses, and pushes the change. The
+// excuses are kept, marked with who revoked them and why, and the change is
+// recorded in the history of the notes. Only the Prefix, ConfigFile, Remote
+// and Store options are used.
+func RevokeExcuse(opts CheckOptions, sel ExcuseSelector, reason string) int {
+	return changeExcuses(opts, sel, reason, func(name string, selected []store.Exclusion) ([]store.Exclusion, error) {
+		return nil, nil
+	})
+}
+
+// AmendExcuse replaces the selected excuse with one changed by the options,
+// and pushes the change. The measures excused are kept, and Measure is
+// ignored. The replaced excuse is kept, marked as amended. Only the Prefix,
+// ConfigFile, Remote and Store options are used.
+func AmendExcuse(opts CheckOptions, sel ExcuseSelector, ex ExcuseOptions, reason string) int {
+	return changeExcuses(opts, sel, reason, func(name string, selected []store.Exclusion) ([]store.Exclusion, error) {
+		if len(selected) > 1 {
+			return nil, errors.New("Several excuses match, pick one by the measure it excuses")
+		}
+
+		amended := selected[0]
+		amended.ID = store.NewExclusionID()
+		amended.Committer = name
+		amended.Revoked = nil
+
+		err := applyExcuse(&amended, ex)
+		return []store.Exclusion{amended}, err
+	})
+}
+
+// changeExcuses revokes the selected excuses, adding those change gives in
+// their place.
+func changeExcuses(opts CheckOptions, sel ExcuseSelector, reason string, change func(name string, selected []store.Exclusion) ([]store.Exclusion, error)) int {
+	if reason == "" {
+		log.FATAL.Println("Give the reason for the change, it's kept with the excuse")
+		return 10
+	}
+
+	config, err := loadConfig(opts)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	s, err := openStore(opts, config)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	name, err := store.GetCommitterName()
+	if err != nil {
+		log.FATAL.Println("Error when fetching committer name")
+		log.DEBUG.Println(err)
+		return 10
+	}
+
+	rev := sel.Commit
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	commit, err := store.ResolveCommit(rev)
+	if err != nil {
+		log.FATAL.Printf("Error resolving %s: %s", rev, err)
+		return 10
+	}
+
+	matches := func(ex store.Exclusion) bool {
+		return ex.Revoked == nil && (sel.Measure == "" || contains(ex.Measure, sel.Measure))
+	}
+
+	// Excuses written on a range of commits are changed on all of them, so
+	// find the commits of the ranges first, to change them all at once.
+	listed, err := s.ListExclusions()
+	if err != nil {
+		log.FATAL.Println(err)
+		return 20
+	}
+
+	hashes := []string{commit}
+	ranges := make(map[string]map[string]bool)
+	for _, ex := range listed {
+		if ex.Commit != commit || !matches(ex) || ex.Range == "" || ranges[ex.Range] != nil {
+			continue
+		}
+
+		commits, _, err := store.ResolveRange(ex.Range)
+		if err != nil {
+			log.FATAL.Println(err)
+			return 20
+		}
+
+		ranges[ex.Range] = make(map[string]bool)
+		for _, c := range commits {
+			ranges[ex.Range][c] = true
+			if c != commit {
+				hashes = append(hashes, c)
+			}
+		}
+	}
+
+	var revocation *store.Revocation
+	var selected, added []store.Exclusion
+
+	code := 0
+	err = s.UpdateExclusions(hashes, func(hash string, exclusions []store.Exclusion) ([]store.Exclusion, error) {
+		if hash != commit {
+			for _, ex := range selected {
+				if ex.Range == "" || !ranges[ex.Range][hash] {
+					continue
+				}
+
+				for i := range exclusions {
+					if exclusions[i].ID == ex.ID && exclusions[i].Revoked == nil {
+						exclusions[i].Revoked = revocation
+					}
+				}
+				for _, amended := range added {
+					if amended.Range == ex.Range {
+						exclusions = append(exclusions, amended)
+					}
+				}
+			}
+			return exclusions, nil
+		}
+
+		selected = make([]store.Exclusion, 0)
+		for _, ex := range exclusions {
+			if matches(ex) {
+				selected = append(selected, ex)
+			}
+		}
+
+		if len(selected) == 0 {
+			code = 10
+			return nil, fmt.Errorf("No excuse found on %s", rev)
+		}
+
+		for _, ex := range selected {
+			if ex.Range != "" && ranges[ex.Range] == nil {
+				code = 10
+				return nil, fmt.Errorf("The excuses on %s changed while reading them, try again", rev)
+			}
+		}
+
+		var err error
+		added, err = change(name, selected)
+		if err != nil {
+			code = 10
+			return nil, err
+		}
+
+		revocation = &store.Revocation{Committer: name, Reason: reason, Timestamp: time.Now().UTC(), Amended: len(added) > 0}
+		for i, ex := range exclusions {
+			if matches(ex) {
+				exclusions[i].Revoked = revocation
+			}
+		}
+
+		return append(exclusions, added...), nil
+	})
+
+	if err != nil {
+		log.FATAL.Println(err)
+		if code == 0 {
+			code = 30
+		}
+		return code
+	}
+
+	err = s.Push()
+
+	if err != nil {
+		log.FATAL.Printf("Error while pushing notes: %s", err)
+		return 70
+	}
+
+	return 0
+}
+
+// parseDate reads a date, as 2006-01-02 for midnight UTC or an RFC 3339 time.
+func parseDate(value string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ExcuseListOptions filters the excuses listed by ListExcuses.
+type ExcuseListOptions struct {
+	// Measure lists only the excuses for the named measure.
+	Measure string
+	// Since and Until list only the excuses on commits made within the dates,
+	// as 2006-01-02 or RFC 3339.
+	Since string
+	Until string
+	// Format is table or json.
+	Format string
+}
+
+// ExcuseEntry is an excuse as listed by ListExcuses and ShowExcuse.
+type ExcuseEntry struct {
+	ID     string `json:"id,omitempty"`
+	Commit string `json:"commit"`
+	// Range is the range of commits the excuse was written on, when it was
+	// written on more than one. ListExcuses lists it once, against the last
+	// commit of the range.
+	Range        string     `json:"range,omitempty"`
+	Timestamp    time.Time  `json:"timestamp"`
+	Committer    string     `json:"committer"`
+	Measures     []string   `json:"measures"`
+	Excuse       string     `json:"excuse"`
+	Max          *float64   `json:"max,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	ExpiresAfter int        `json:"expiresAfter,omitempty"`
+	// Consumed is set once measures have been stored after the excuse, so the
+	// next check no longer reads it.
+	Consumed bool              `json:"consumed"`
+	Expired  bool              `json:"expired"`
+	Revoked  *store.Revocation `json:"revoked,omitempty"`
+}
+
+// ListExcuses writes the stored excuses to output, most recent first. Only the
+// Prefix, ConfigFile, AllParents and Store options are used.
+func ListExcuses(opts CheckOptions, list ExcuseListOptions, output io.Writer) int {
+	if list.Format == "" {
+		list.Format = "table"
+	}
+	if list.Format != "table" && list.Format != "json" {
+		log.FATAL.Println("Unknown output format: " + list.Format)
+		return 10
+	}
+
+	var since, until time.Time
+	var err error
+	if list.Since != "" {
+		if since, err = parseDate(list.Since); err != nil {
+			log.FATAL.Printf("Invalid date %s, expected 2006-01-02 or RFC 3339", list.Since)
+			return 10
+		}
+	}
+	if list.Until != "" {
+		if until, err = parseDate(list.Until); err != nil {
+			log.FATAL.Printf("Invalid date %s, expected 2006-01-02 or RFC 3339", list.Until)
+			return 10
+		}
+	}
+
+	entries, code := excuseEntries(opts)
+	if code != 0 {
+		return code
+	}
+
+	filtered := make([]ExcuseEntry, 0, len(entries))
+	for _, e := range collapseRanges(entries) {
+		if list.Measure != "" && !contains(e.Measures, list.Measure) {
+			continue
+		}
+		if !since.IsZero() && e.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && e.Timestamp.After(until) {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+
+	if list.Format == "json" {
+		err = writeJSON(output, filtered)
+	} else {
+		err = writeExcuseTable(output, filtered)
+	}
+	if err != nil {
+		log.FATAL.Println(err)
+		return 60
+	}
+
 	return 0
 }
+
+// ShowExcuse writes the excuses on the commit named by rev to output, in the
+// text or json format. Only the Prefix, ConfigFile, AllParents and Store
+// options are used.
+func ShowExcuse(opts CheckOptions, rev string, format string, output io.Writer) int {
+	if format == "" {
+		format = "text"
+	}
+	if format != "text" && format != "json" {
+		log.FATAL.Println("Unknown output format: " + format)
+		return 10
+	}
+
+	entries, code := excuseEntries(opts)
+	if code != 0 {
+		return code
+	}
+
+	// Anything git can't resolve, like commits which have been pruned, is
+	// matched as a hash prefix.
+	commit, err := store.ResolveCommit(rev)
+	if err != nil {
+		log.INFO.Printf("Matching %s as a hash prefix: %s", rev, err)
+		commit = rev
+	}
+
+	shown := make([]ExcuseEntry, 0)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Commit, commit) {
+			shown = append(shown, e)
+		}
+	}
+
+	if len(shown) == 0 {
+		log.FATAL.Printf("No excuse found on %s", rev)
+		return 10
+	}
+
+	if format == "json" {
+		err = writeJSON(output, shown)
+	} else {
+		for i, e := range shown {
+			if i > 0 {
+				fmt.Fprintln(output)
+			}
+			err = writeExcuseText(output, e)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.FATAL.Println(err)
+		return 60
+	}
+
+	return 0
+}
+
+// excuseEntries reads every stored excuse, working out which the next check
+// reads from the history it searches.
+func excuseEntries(opts CheckOptions) ([]ExcuseEntry, int) {
+	config, err := loadConfig(opts)
+	if err != nil {
+		log.FATAL.Println(err)
+		return nil, 10
+	}
+
+	s, err := openStore(opts, config)
+	if err != nil {
+		log.FATAL.Println(err)
+		return nil, 20
+	}
+
+	exclusions, err := s.ListExclusions()
+	if err != nil {
+		log.FATAL.Println(err)
+		return nil, 20
+	}
+
+	stored, pending, err := pendingExcuses(opts, s)
+	if err != nil {
+		log.FATAL.Println(err)
+		return nil, 20
+	}
+
+	entries := make([]ExcuseEntry, 0, len(exclusions))
+	for _, ex := range exclusions {
+		expired, err := ex.Expired(s)
+		if err != nil {
+			log.FATAL.Println(err)
+			return nil, 20
+		}
+
+		// An excuse is consumed when the last stored measures are on or after
+		// its commit, and it's no longer read. One on a commit they can't
+		// reach, like on another branch, may still be read.
+		consumed := false
+		if stored != "" && !pending[excuseKey(ex)] {
+			consumed, err = s.Reaches(stored, ex.Commit)
+			if err != nil {
+				log.FATAL.Println(err)
+				return nil, 20
+			}
+		}
+
+		entries = append(entries, ExcuseEntry{ID: ex.ID,
+			Commit:       ex.Commit,
+			Range:        ex.Range,
+			Timestamp:    ex.Timestamp,
+			Committer:    ex.Committer,
+			Measures:     ex.Measure,
+			Excuse:       ex.Excuse,
+			Max:          ex.Max,
+			Expires:      ex.Expires,
+			ExpiresAfter: ex.ExpiresAfter,
+			Consumed:     consumed,
+			Expired:      expired,
+			Revoked:      ex.Revoked})
+	}
+
+	return entries, 0
+}
+
+// collapseRanges gives the excuses written on a range of commits once, against
+// the last commit of the range. They're consumed once consumed on any commit,
+// as the copies on the later commits aren't read again.
+func collapseRanges(entries []ExcuseEntry) []ExcuseEntry {
+	collapsed := make([]ExcuseEntry, 0, len(entries))
+	index := make(map[string]int)
+
+	for _, e := range entries {
+		if e.Range == "" || e.ID == "" {
+			collapsed = append(collapsed, e)
+			continue
+		}
+
+		i, ok := index[e.ID]
+		if !ok {
+			index[e.ID] = len(collapsed)
+			collapsed = append(collapsed, e)
+			continue
+		}
+
+		consumed := collapsed[i].Consumed || e.Consumed
+		if strings.HasSuffix(e.Range, ".."+e.Commit) {
+			collapsed[i] = e
+		}
+		collapsed[i].Consumed = consumed
+	}
+
+	return collapsed
+}
+
+// pendingExcuses gives the commit of the most recently stored measures, and the
+// excuses the next check reads, by excuseKey. The commit is empty if nothing
+// is stored yet.
+func pendingExcuses(opts CheckOptions, s store.Store) (string, map[string]bool, error) {
+	readStoredMeasure, err := s.CommitMeasures(historyOptions(opts))
+	if err != nil {
+		return "", nil, err
+	}
+
+	cm, err := readStoredMeasure()
+	if err == io.EOF || err == store.ErrNoNotes || err == store.ErrShallowHistory {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	exclusions, err := s.Exclusions(cm.CommitHash)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pending := make(map[string]bool)
+	for _, ex := range exclusions {
+		pending[excuseKey(ex)] = true
+	}
+	return cm.CommitHash, pending, nil
+}
+
+// excuseKey tells excuses apart by ID, where they have one. Those written by
+// older versions don't, and are told apart by commit.
+func excuseKey(ex store.Exclusion) string {
+	if ex.ID != "" {
+		return ex.ID
+	}
+	return ex.Commit
+}
+
+func writeExcuseTable(w io.Writer, entries []ExcuseEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMMIT\tDATE\tCOMMITTER\tMEASURES\tCONSUMED\tEXPIRED\tREVOKED\tEXCUSE")
+	for _, e := range entries {
+		commit := shortHash(e.Commit)
+		if e.Range != "" {
+			commit = shortRange(e.Range)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", commit, formatDate(e.Timestamp), e.Committer,
+			strings.Join(e.Measures, ","), yesNo(e.Consumed), yesNo(e.Expired), yesNo(e.Revoked != nil), e.Excuse)
+	}
+	return tw.Flush()
+}
+
+func writeExcuseText(w io.Writer, e ExcuseEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if e.ID != "" {
+		fmt.Fprintf(tw, "ID:\t%s\n", e.ID)
+	}
+	fmt.Fprintf(tw, "Commit:\t%s\n", e.Commit)
+	if e.Range != "" {
+		fmt.Fprintf(tw, "Range:\t%s\n", e.Range)
+	}
+	fmt.Fprintf(tw, "Date:\t%s\n", formatDate(e.Timestamp))
+	fmt.Fprintf(tw, "Committer:\t%s\n", e.Committer)
+	fmt.Fprintf(tw, "Measures:\t%s\n", strings.Join(e.Measures, ", "))
+	if e.Max != nil {
+		fmt.Fprintf(tw, "Max:\t%g\n", *e.Max)
+	}
+	if e.Expires != nil {
+		fmt.Fprintf(tw, "Expires:\t%s\n", e.Expires.Format(time.RFC3339))
+	}
+	if e.ExpiresAfter > 0 {
+		fmt.Fprintf(tw, "Expires after:\t%d commits\n", e.ExpiresAfter)
+	}
+	fmt.Fprintf(tw, "Consumed:\t%s\n", yesNo(e.Consumed))
+	fmt.Fprintf(tw, "Expired:\t%s\n", yesNo(e.Expired))
+	if e.Revoked != nil {
+		verb := "Revoked"
+		if e.Revoked.Amended {
+			verb = "Amended"
+		}
+		fmt.Fprintf(tw, "%s:\t%s by %s, %s\n", verb, formatDate(e.Revoked.Timestamp), e.Revoked.Committer, e.Revoked.Reason)
+	}
+	fmt.Fprintf(tw, "Excuse:\t%s\n", e.Excuse)
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// shortRange abbreviates the hashes of a from..to range.
+func shortRange(r string) string {
+	parts := strings.SplitN(r, "..", 2)
+	if len(parts) != 2 {
+		return r
+	}
+	return shortHash(parts[0]) + ".." + shortHash(parts[1])
+}
+
+// formatDate gives the date of a commit, or - when the commit isn't in the
+// repository.
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
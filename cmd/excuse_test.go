@@ -0,0 +1,537 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/spf13/jwalterweatherman"
+)
+
+func TestExcuseList(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
+	writeExcuse(t, "", "foo", "First")
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Second Commit"))
+
+	runCheck(t, true, "foo,5")
+	writeExcuse(t, "", "bar", "Second")
+
+	entries := listExcuses(t, ExcuseListOptions{})
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 excuses, got %d", len(entries))
+	}
+
+	for _, e := range entries {
+		switch e.Excuse {
+		case "First":
+			// Measures have been stored since, on the second commit.
+			if !e.Consumed || e.Measures[0] != "foo" {
+				t.Fatalf("Unexpected excuse listed %+v", e)
+			}
+		case "Second":
+			if e.Consumed || e.Measures[0] != "bar" || e.Timestamp.IsZero() {
+				t.Fatalf("Unexpected excuse listed %+v", e)
+			}
+		default:
+			t.Fatalf("Unexpected excuse listed %+v", e)
+		}
+	}
+
+	entries = listExcuses(t, ExcuseListOptions{Measure: "bar"})
+	if len(entries) != 1 || entries[0].Excuse != "Second" {
+		t.Fatalf("Unexpected excuses listed for bar %+v", entries)
+	}
+
+	entries = listExcuses(t, ExcuseListOptions{Since: "2090-01-01"})
+	if len(entries) != 0 {
+		t.Fatalf("Unexpected excuses listed since 2090 %+v", entries)
+	}
+
+	var b bytes.Buffer
+	errCode := ListExcuses(CheckOptions{}, ExcuseListOptions{Format: "table"}, &b)
+	if errCode != 0 {
+		t.Fatalf("Excuse list command failed! Error code: %d", errCode)
+	}
+	if lines := strings.Split(strings.TrimSpace(b.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "COMMIT") {
+		t.Fatalf("Unexpected table %s", b.String())
+	}
+
+	errCode = ListExcuses(CheckOptions{}, ExcuseListOptions{Format: "xml"}, &b)
+	if errCode != 10 {
+		t.Fatalf("Excuse list command accepted an unknown format!")
+	}
+
+	errCode = ListExcuses(CheckOptions{}, ExcuseListOptions{Format: "table", Until: "tomorrow"}, &b)
+	if errCode != 10 {
+		t.Fatalf("Excuse list command accepted an invalid date!")
+	}
+}
+
+func TestExcuseListOtherBranches(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCommand(t, repo, exec.Command("git", "branch", "-M", "main"))
+	runCheck(t, true, "foo,5")
+
+	// An excuse on a branch which hasn't been merged.
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "-b", "side"))
+	runCommand(t, repo, exec.Command("git", "commit", "--allow-empty", "-m", "Side Commit"))
+	errCode := Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Side"})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	// An excuse on a commit which has since been deleted.
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "-b", "gone"))
+	runCommand(t, repo, exec.Command("git", "commit", "--allow-empty", "-m", "Gone Commit"))
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Gone", ExpiresAfter: 1})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	gone, _ := exec.Command("git", "rev-parse", "HEAD").Output()
+	object := strings.TrimSpace(string(gone))
+
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "side"))
+	runCommand(t, repo, exec.Command("git", "branch", "-D", "gone"))
+	os.Remove(filepath.Join(repo, ".git", "objects", object[:2], object[2:]))
+
+	// Measures are stored on the main branch after both.
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "main"))
+	runCommand(t, repo, exec.Command("git", "commit", "--allow-empty", "-m", "Main Commit"))
+	runCheck(t, true, "foo,5")
+
+	entries := listExcuses(t, ExcuseListOptions{})
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 excuses, got %+v", entries)
+	}
+
+	for _, e := range entries {
+		if e.Consumed || e.Expired {
+			t.Fatalf("Unexpected excuse listed %+v", e)
+		}
+	}
+}
+
+func TestExcuseShow(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
+
+	max := 3.0
+	errCode := Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Hotfix", Max: &max, ExpiresAfter: 2})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	var b bytes.Buffer
+	errCode = ShowExcuse(CheckOptions{}, "HEAD", "text", &b)
+	if errCode != 0 {
+		t.Fatalf("Excuse show command failed! Error code: %d", errCode)
+	}
+	for _, want := range []string{"Hotfix", "Max:", "Expires after:"} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("Expected %q in %s", want, b.String())
+		}
+	}
+
+	b.Reset()
+	errCode = ShowExcuse(CheckOptions{}, "HEAD", "json", &b)
+	if errCode != 0 {
+		t.Fatalf("Excuse show command failed! Error code: %d", errCode)
+	}
+
+	var entries []ExcuseEntry
+	err := json.Unmarshal(b.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("Failed to read the excuse %s", err)
+	}
+	if len(entries) != 1 || *entries[0].Max != 3 || entries[0].ExpiresAfter != 2 || entries[0].Consumed {
+		t.Fatalf("Unexpected excuse shown %+v", entries)
+	}
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Second Commit"))
+
+	errCode = ShowExcuse(CheckOptions{}, "HEAD", "text", &b)
+	if errCode != 10 {
+		t.Fatalf("Excuse show command found an excuse on a commit without one!")
+	}
+
+	errCode = ShowExcuse(CheckOptions{}, "HEAD~1", "text", &b)
+	if errCode != 0 {
+		t.Fatalf("Excuse show command failed! Error code: %d", errCode)
+	}
+}
+
+func TestExcuseSeveral(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5\nbar,5")
+
+	// A second excuse on the same commit is added, rather than replacing the
+	// first.
+	writeExcuse(t, "", "foo", "First")
+	writeExcuse(t, "", "bar", "Second")
+
+	runCheck(t, false, "foo,6\nbar,6")
+
+	entries := listExcuses(t, ExcuseListOptions{})
+	if len(entries) != 2 || entries[0].ID == "" || entries[0].ID == entries[1].ID {
+		t.Fatalf("Unexpected excuses listed %+v", entries)
+	}
+}
+
+func TestExcuseRevoke(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5\nbar,5")
+
+	writeExcuse(t, "", "foo", "First")
+	writeExcuse(t, "", "bar", "Second")
+
+	errCode := RevokeExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, "")
+	if errCode != 10 {
+		t.Fatalf("Excuse revoke command accepted a missing reason!")
+	}
+
+	errCode = RevokeExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, "Fixed after all")
+	if errCode != 0 {
+		t.Fatalf("Excuse revoke command failed! Error code: %d", errCode)
+	}
+
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,6\nbar,6"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, false, "foo,5\nbar,6")
+
+	// The revoked excuse is kept for the record.
+	entries := listExcuses(t, ExcuseListOptions{Measure: "foo"})
+	if len(entries) != 1 || entries[0].Revoked == nil || entries[0].Revoked.Reason != "Fixed after all" || entries[0].Revoked.Amended {
+		t.Fatalf("Unexpected excuses listed %+v", entries)
+	}
+
+	errCode = RevokeExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, "Again")
+	if errCode != 10 {
+		t.Fatalf("Excuse revoke command revoked an excuse twice!")
+	}
+}
+
+func TestExcuseAmend(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5\nbar,5")
+
+	writeExcuse(t, "", "foo", "First")
+	writeExcuse(t, "", "bar", "Second")
+
+	max := 1.0
+	errCode := AmendExcuse(CheckOptions{}, ExcuseSelector{}, ExcuseOptions{Max: &max}, "Too loose")
+	if errCode != 10 {
+		t.Fatalf("Excuse amend command amended several excuses at once!")
+	}
+
+	errCode = AmendExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, ExcuseOptions{Max: &max}, "Too loose")
+	if errCode != 0 {
+		t.Fatalf("Excuse amend command failed! Error code: %d", errCode)
+	}
+
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,7\nbar,7"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, false, "foo,6\nbar,7")
+
+	entries := listExcuses(t, ExcuseListOptions{Measure: "foo"})
+	if len(entries) != 2 {
+		t.Fatalf("Unexpected excuses listed %+v", entries)
+	}
+	for _, e := range entries {
+		amended := e.Revoked != nil && e.Revoked.Amended && e.Max == nil
+		amendment := e.Revoked == nil && *e.Max == 1 && e.Excuse == "First"
+		if !amended && !amendment {
+			t.Fatalf("Unexpected excuse listed %+v", e)
+		}
+	}
+
+	errCode = AmendExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, ExcuseOptions{Max: &max, NoMax: true}, "Both")
+	if errCode != 10 {
+		t.Fatalf("Excuse amend command accepted a maximum and dropping it!")
+	}
+
+	// Dropping the maximum excuses any change again.
+	errCode = AmendExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, ExcuseOptions{NoMax: true}, "Too tight")
+	if errCode != 0 {
+		t.Fatalf("Excuse amend command failed! Error code: %d", errCode)
+	}
+
+	runCheck(t, false, "foo,7\nbar,7")
+
+	errCode = AmendExcuse(CheckOptions{}, ExcuseSelector{Commit: "missing", Measure: "foo"}, ExcuseOptions{NoMax: true}, "Missing")
+	if errCode != 10 {
+		t.Fatalf("Excuse amend command accepted a missing commit!")
+	}
+}
+
+func TestExcusePushFailure(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
+
+	// The remote can't be pushed to, so each change fails once it's written.
+	runCommand(t, repo, exec.Command("git", "remote", "add", "origin", repo+"-missing.git"))
+
+	errCode := Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Unpushed"})
+	if errCode != 70 {
+		t.Fatalf("Excuse command didn't fail to push! Error code: %d", errCode)
+	}
+
+	max := 1.0
+	errCode = AmendExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, ExcuseOptions{Max: &max}, "Too loose")
+	if errCode != 70 {
+		t.Fatalf("Excuse amend command didn't fail to push! Error code: %d", errCode)
+	}
+
+	errCode = RevokeExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, "Fixed after all")
+	if errCode != 70 {
+		t.Fatalf("Excuse revoke command didn't fail to push! Error code: %d", errCode)
+	}
+
+	entries := listExcuses(t, ExcuseListOptions{Measure: "foo"})
+	if len(entries) != 2 || entries[0].Revoked == nil || entries[1].Revoked == nil {
+		t.Fatalf("Unexpected excuses listed %+v", entries)
+	}
+}
+
+func TestExcuseRevokeMerge(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+	remote := repo + ".git"
+	other := repo + "-other"
+
+	runCommand(t, repo, exec.Command("git", "clone", "--bare", repo, remote))
+	runCommand(t, repo, exec.Command("git", "remote", "add", "origin", remote))
+	runCommand(t, repo, exec.Command("git", "clone", remote, other))
+
+	runCheck(t, true, "foo,5")
+	writeExcuse(t, "", "foo", "First")
+
+	// Another clone adds an excuse to the same commit, and revokes the first.
+	os.Chdir(other)
+	runCommand(t, other, exec.Command("git", "config", "user.name", "Other Name"))
+	runSync(t, "origin")
+
+	writeExcuse(t, "", "bar", "Second")
+
+	errCode := RevokeExcuse(CheckOptions{}, ExcuseSelector{Measure: "foo"}, "Fixed after all")
+	if errCode != 0 {
+		t.Fatalf("Excuse revoke command failed! Error code: %d", errCode)
+	}
+
+	os.Chdir(repo)
+	writeExcuse(t, "", "baz", "Third")
+
+	entries := listExcuses(t, ExcuseListOptions{})
+	if len(entries) != 3 {
+		t.Fatalf("Unexpected excuses listed %+v", entries)
+	}
+	for _, e := range entries {
+		if (e.Excuse == "First") != (e.Revoked != nil) {
+			t.Fatalf("Unexpected excuse listed %+v", e)
+		}
+	}
+}
+
+func TestExcuseCommit(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5\nbar,5")
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Third Commit"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test3.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Fourth Commit"))
+
+	errCode := Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Already pushed", Commit: "HEAD~1"})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	var b bytes.Buffer
+	if errCode = ShowExcuse(CheckOptions{}, "HEAD~1", "text", &b); errCode != 0 {
+		t.Fatalf("Excuse show command failed! Error code: %d", errCode)
+	}
+	if errCode = ShowExcuse(CheckOptions{}, "HEAD", "text", &b); errCode != 10 {
+		t.Fatalf("Excuse written on HEAD, not the commit given!")
+	}
+
+	runCheck(t, true, "foo,6\nbar,5")
+
+	// An excuse on a commit before the stored measures is out of scope.
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "bar", Excuse: "Too late", Commit: "HEAD~1"})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,6\nbar,6"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "bar", Excuse: "Both", Commit: "HEAD", Range: "HEAD~1..HEAD"})
+	if errCode != 10 {
+		t.Fatalf("Excuse command accepted both a commit and a range!")
+	}
+
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "bar", Excuse: "Missing", Commit: "nonexistent"})
+	if errCode != 10 {
+		t.Fatalf("Excuse command accepted a missing commit!")
+	}
+}
+
+func TestExcuseRange(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	runCheck(t, true, "foo,5")
+
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test2.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Third Commit"))
+	runCommand(t, repo, exec.Command("git", "add", createFile(t, repo, "test3.txt").Name()))
+	runCommand(t, repo, exec.Command("git", "commit", "-m", "Fourth Commit"))
+
+	errCode := Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Range", Range: "HEAD"})
+	if errCode != 10 {
+		t.Fatalf("Excuse command accepted an invalid range!")
+	}
+
+	max := 1.0
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Whole branch", Max: &max, Range: "HEAD~2.."})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	// The excuse is read once, even though it's on both commits.
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,7"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, false, "foo,6")
+
+	// Checks of earlier commits in the range are excused too.
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "HEAD~1"))
+	runCheck(t, false, "foo,6")
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "-"))
+
+	entries := listExcuses(t, ExcuseListOptions{})
+	head, _ := exec.Command("git", "rev-parse", "HEAD").Output()
+	if len(entries) != 1 || entries[0].Range == "" || entries[0].Commit != strings.TrimSpace(string(head)) {
+		t.Fatalf("Unexpected excuses listed %+v", entries)
+	}
+
+	// Revoking the excuse on one commit revokes it on the whole range.
+	errCode = RevokeExcuse(CheckOptions{}, ExcuseSelector{Commit: "HEAD~1"}, "Not the whole branch")
+	if errCode != 0 {
+		t.Fatalf("Excuse revoke command failed! Error code: %d", errCode)
+	}
+
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,6"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	errCode = Excuse(CheckOptions{}, ExcuseOptions{Measure: "foo", Excuse: "Whole branch again", Max: &max, Range: "HEAD~2.."})
+	if errCode != 0 {
+		t.Fatalf("Excuse command failed! Error code: %d", errCode)
+	}
+
+	// Once measures are stored with the excuse on one commit of the range,
+	// its copies on the later commits aren't read again.
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "HEAD~1"))
+	runCheck(t, true, "foo,6")
+	runCommand(t, repo, exec.Command("git", "checkout", "-q", "-"))
+
+	errCode = Check(CheckOptions{InputType: "csv"}, strings.NewReader("foo,7"))
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, false, "foo,6")
+}
+
+func listExcuses(t *testing.T, opts ExcuseListOptions) []ExcuseEntry {
+	opts.Format = "json"
+
+	var b bytes.Buffer
+	errCode := ListExcuses(CheckOptions{}, opts, &b)
+	if errCode != 0 {
+		t.Fatalf("Excuse list command failed! Error code: %d", errCode)
+	}
+
+	var entries []ExcuseEntry
+	err := json.Unmarshal(b.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("Failed to read the excuses listed %s", err)
+	}
+	return entries
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/iangrunert/git-ratchet/store"
+	log "github.com/spf13/jwalterweatherman"
+)
+
+// Migrate converts the version 1 notes for the prefix to version 2 notes, then
+// verifies them. If the verification fails the migration is rolled back.
+func Migrate(prefix string, version string, dryRun bool) int {
+	s := store.NewGitStore(prefix)
+
+	migrated, err := s.Migrate(version, dryRun)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 30
+	}
+
+	if dryRun {
+		log.FEEDBACK.Printf("%d notes would be migrated.", migrated)
+		return 0
+	}
+
+	log.FEEDBACK.Printf("Migrated %d notes.", migrated)
+
+	verified, err := s.VerifyMigration()
+	if err != nil {
+		log.FATAL.Println(err)
+
+		removed, rollbackErr := s.RollbackMigration()
+		if rollbackErr != nil {
+			log.FATAL.Println("Error rolling back migration", rollbackErr)
+			return 40
+		}
+
+		log.FEEDBACK.Printf("Rolled back %d notes.", removed)
+		return 50
+	}
+
+	log.FEEDBACK.Printf("Verified %d notes.", verified)
+	return 0
+}
+
+// VerifyMigration checks every version 1 note for the prefix has been
+// migrated.
+func VerifyMigration(prefix string) int {
+	verified, err := store.NewGitStore(prefix).VerifyMigration()
+	if err != nil {
+		log.FATAL.Println(err)
+		return 50
+	}
+
+	log.FEEDBACK.Printf("Verified %d notes.", verified)
+	return 0
+}
+
+// RollbackMigration removes the migrated notes for the prefix.
+func RollbackMigration(prefix string) int {
+	removed, err := store.NewGitStore(prefix).RollbackMigration()
+	if err != nil {
+		log.FATAL.Println(err)
+		return 30
+	}
+
+	log.FEEDBACK.Printf("Rolled back %d notes.", removed)
+	return 0
+}
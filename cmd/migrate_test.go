@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iangrunert/git-ratchet/store"
+	log "github.com/spf13/jwalterweatherman"
+)
+
+func TestMigrate(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	commit := exec.Command("git", "commit", "--allow-empty", "-m", "Old Commit")
+	commit.Env = append(os.Environ(), "GIT_COMMITTER_DATE=2001-02-03T04:05:06Z")
+	runCommand(t, repo, commit)
+
+	// Notes written by older versions.
+	runCommand(t, repo, exec.Command("git", "notes", "--ref=git-ratchet-1-foo", "add", "-m", "foo,5,5", "HEAD^"))
+	runCommand(t, repo, exec.Command("git", "notes", "--ref=git-ratchet-1-foo", "add", "-m", "foo,4,4\nbar,1,1", "HEAD"))
+
+	if errCode := VerifyMigration("foo"); errCode != 50 {
+		t.Fatalf("Verify passed before migrating!")
+	}
+
+	runMigrate(t, "foo", true)
+
+	if exec.Command("git", "notes", "--ref=git-ratchet-2-foo", "show", "HEAD").Run() == nil {
+		t.Fatalf("Dry run migrated notes")
+	}
+
+	runMigrate(t, "foo", false)
+
+	if errCode := VerifyMigration("foo"); errCode != 0 {
+		t.Fatalf("Verify failed after migrating! Error code: %d", errCode)
+	}
+
+	// Migrated notes are dated by their commit.
+	output, err := exec.Command("git", "notes", "--ref=git-ratchet-2-foo", "show", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Failed to read note %s", err)
+	}
+
+	note, err := store.ParseNote(strings.NewReader(string(output)))
+	if err != nil {
+		t.Fatalf("Failed to parse note %s", err)
+	}
+
+	if !note.Timestamp.Equal(time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)) {
+		t.Fatalf("Expected the migrated note to be dated by its commit, got %s", note.Timestamp)
+	}
+
+	// Drop the version 1 notes, so the measures can only be read from the
+	// migrated notes.
+	runCommand(t, repo, exec.Command("git", "update-ref", "-d", "refs/notes/git-ratchet-1-foo"))
+
+	dump := strings.Split(strings.TrimSpace(runDump(t, "foo").String()), "\n")
+
+	if len(dump) != 3 {
+		t.Fatalf("Expected 3 migrated measures, got %s", dump)
+	}
+
+	checkString(t, "bar,1,1", dump[0])
+	checkString(t, "foo,4,4", dump[1])
+	checkString(t, "foo,5,5", dump[2])
+
+	// Migrating again changes nothing.
+	runMigrate(t, "foo", false)
+
+	if errCode := RollbackMigration("foo"); errCode != 0 {
+		t.Fatalf("Rollback failed! Error code: %d", errCode)
+	}
+
+	if len(runDump(t, "foo").Bytes()) > 0 {
+		t.Fatalf("Migrated notes left after rolling back")
+	}
+}
+
+func runMigrate(t *testing.T, prefix string, dryRun bool) {
+	t.Logf("Running migrate command p: %s n: %t", prefix, dryRun)
+
+	errCode := Migrate(prefix, "test", dryRun)
+
+	if errCode != 0 {
+		t.Fatalf("Migrate command failed! Error code: %d", errCode)
+	}
+}
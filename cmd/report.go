@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/iangrunert/git-ratchet/store"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Report is the outcome of a check, written in the requested format.
+type Report struct {
+	Prefix string `json:"prefix"`
+	// BaselineCommit is the commit the measures were compared against, empty
+	// when nothing was stored.
+	BaselineCommit    string         `json:"baselineCommit,omitempty"`
+	BaselineCommitter string         `json:"baselineCommitter,omitempty"`
+	Passed            bool           `json:"passed"`
+	Measures          []store.Result `json:"measures"`
+}
+
+// reportWriters maps each output format to the function writing a report in
+// that format. The text format is left out, it's the log output.
+var reportWriters = map[string]func(io.Writer, CheckOptions, Report) error{
+	"json":     writeJSONReport,
+	"github":   writeGitHubReport,
+	"gitlab":   writeGitLabReport,
+	"markdown": writeMarkdownReport,
+}
+
+func checkFormat(format string) error {
+	if _, ok := reportWriters[format]; !ok && format != "" && format != "text" {
+		return errors.New("Unknown output format: " + format)
+	}
+	return nil
+}
+
+func writeReport(opts CheckOptions, r Report) error {
+	writef, ok := reportWriters[opts.Format]
+	if !ok || opts.Output == nil {
+		return nil
+	}
+	return writef(opts.Output, opts, r)
+}
+
+func writeJSONReport(w io.Writer, opts CheckOptions, r Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// writeGitHubReport writes GitHub Actions workflow commands, which annotate
+// the workflow run and pull request with each failing or excused measure.
+func writeGitHubReport(w io.Writer, opts CheckOptions, r Report) error {
+	for _, result := range r.Measures {
+		level := "error"
+		if result.Passed {
+			if !result.Excused {
+				continue
+			}
+			level = "warning"
+		}
+
+		_, err := fmt.Fprintf(w, "::%s title=%s::%s\n", level, escapeGitHubProperty(title(result)), escapeGitHubData(describe(result)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func escapeGitHubData(s string) string {
+	s = strings.Replace(s, "%", "%25", -1)
+	s = strings.Replace(s, "\r", "%0D", -1)
+	return strings.Replace(s, "\n", "%0A", -1)
+}
+
+func escapeGitHubProperty(s string) string {
+	s = escapeGitHubData(s)
+	s = strings.Replace(s, ":", "%3A", -1)
+	return strings.Replace(s, ",", "%2C", -1)
+}
+
+type gitLabIssue struct {
+	Type        string         `json:"type"`
+	CheckName   string         `json:"check_name"`
+	Description string         `json:"description"`
+	Categories  []string       `json:"categories"`
+	Fingerprint string         `json:"fingerprint"`
+	Severity    string         `json:"severity"`
+	Location    gitLabLocation `json:"location"`
+}
+
+type gitLabLocation struct {
+	Path  string `json:"path"`
+	Lines struct {
+		Begin int `json:"begin"`
+	} `json:"lines"`
+}
+
+// writeGitLabReport writes a GitLab Code Quality report, which shows each
+// failing or excused measure in the merge request. Measures don't belong to a
+// source file, so the issues point at the config file.
+func writeGitLabReport(w io.Writer, opts CheckOptions, r Report) error {
+	path := opts.ConfigFile
+	if path == "" {
+		path = store.DefaultConfigFile
+	}
+
+	issues := make([]gitLabIssue, 0)
+
+	for _, result := range r.Measures {
+		severity := "major"
+		if result.Passed {
+			if !result.Excused {
+				continue
+			}
+			severity = "info"
+		}
+
+		issue := gitLabIssue{
+			Type:        "issue",
+			CheckName:   "git-ratchet",
+			Description: describe(result),
+			Categories:  []string{"Complexity"},
+			Fingerprint: fmt.Sprintf("%x", md5.Sum([]byte(r.Prefix+"\x00"+result.Name))),
+			Severity:    severity,
+		}
+		issue.Location.Path = path
+		issue.Location.Lines.Begin = 1
+
+		issues = append(issues, issue)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(issues)
+}
+
+// writeMarkdownReport writes a table of the measures, to post as a pull request
+// comment or append to $GITHUB_STEP_SUMMARY.
+func writeMarkdownReport(w io.Writer, opts CheckOptions, r Report) error {
+	status := "passing"
+	if !r.Passed {
+		status = "failing"
+	}
+
+	heading := "git-ratchet"
+	if r.Prefix != "" {
+		heading += " (" + r.Prefix + ")"
+	}
+
+	fmt.Fprintf(w, "### %s: %s\n\n", heading, status)
+
+	if r.BaselineCommit != "" {
+		fmt.Fprintf(w, "Compared against `%s`, measured by %s.\n\n", shortHash(r.BaselineCommit), r.BaselineCommitter)
+	} else {
+		fmt.Fprint(w, "No stored measures to compare against.\n\n")
+	}
+
+	fmt.Fprint(w, "| Measure | Baseline → Current | Delta | Status | Excuse used |\n")
+	fmt.Fprint(w, "| --- | ---: | ---: | --- | --- |\n")
+
+	for _, result := range r.Measures {
+		baseline, value, delta := store.FormatValue(result.Baseline), store.FormatValue(result.Value), "–"
+		if result.New {
+			baseline = "–"
+		} else if result.Missing {
+			value = "–"
+		} else {
+			delta = fmt.Sprintf("%s (%s%%)", formatDelta(result.Delta), formatDelta(result.DeltaPercent))
+		}
+
+		status := ":white_check_mark: passing"
+		switch {
+		case !result.Passed:
+			status = ":x: failing"
+		case result.Missing:
+			status = ":heavy_minus_sign: missing"
+		case result.New:
+			status = ":new: new"
+		}
+
+		excused := "no"
+		if result.Excused {
+			excused = "yes"
+		}
+
+		_, err := fmt.Fprintf(w, "| %s | %s → %s | %s | %s | %s |\n",
+			strings.Replace(result.Name, "|", "\\|", -1), baseline, value, delta, status, excused)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
+
+// title summarises the result of checking a measure.
+func title(result store.Result) string {
+	switch {
+	case result.Missing:
+		return "Measure missing: " + result.Name
+	case result.New:
+		return "Measure new: " + result.Name
+	case result.Direction == store.HigherIsBetter && result.Delta < 0:
+		return "Measure falling: " + result.Name
+	case result.Delta > 0:
+		return "Measure rising: " + result.Name
+	default:
+		return "Measure passing: " + result.Name
+	}
+}
+
+// describe explains the result of checking a measure in a sentence.
+func describe(result store.Result) string {
+	if result.Missing {
+		return fmt.Sprintf("%s was not measured, its baseline is %s.", result.Name, store.FormatValue(result.Baseline))
+	}
+
+	if result.New {
+		return fmt.Sprintf("%s is new, measured at %s.", result.Name, store.FormatValue(result.Value))
+	}
+
+	moved := "rose"
+	if result.Delta < 0 {
+		moved = "fell"
+	}
+
+	slack := store.FormatValue(result.Slack)
+	if result.UsePercents {
+		slack += "%"
+	}
+
+	s := fmt.Sprintf("%s %s from %s to %s (%s, %s%%), the slack is %s.", result.Name, moved,
+		store.FormatValue(result.Baseline), store.FormatValue(result.Value),
+		formatDelta(result.Delta), formatDelta(result.DeltaPercent), slack)
+
+	if result.Excused {
+		s += " An excuse was used."
+	}
+
+	return s
+}
+
+func formatDelta(delta float64) string {
+	s := strconv.FormatFloat(delta, 'f', 2, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		s = "0"
+	}
+	if delta > 0 {
+		s = "+" + s
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/iangrunert/git-ratchet/store"
+	log "github.com/spf13/jwalterweatherman"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+)
+
+// Run executes every measurement command in the config file, and checks the
+// measures they produce together, as check would. The InputType and GroupBy
+// options are ignored, each command declares its own.
+func Run(opts CheckOptions) int {
+	if err := checkFormat(opts.Format); err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	config, err := loadConfig(opts)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	if len(config.Commands) == 0 {
+		log.FATAL.Println("No commands found in config.")
+		return 10
+	}
+
+	passedMeasures := make([]store.Measure, 0)
+
+	for _, command := range config.Commands {
+		measures, err := runMeasurement(command)
+		if err != nil {
+			log.FATAL.Println(err)
+			return 10
+		}
+
+		passedMeasures = append(passedMeasures, measures...)
+	}
+
+	sort.Sort(store.ByName(passedMeasures))
+
+	for i := 1; i < len(passedMeasures); i++ {
+		if passedMeasures[i].Name == passedMeasures[i-1].Name {
+			log.FATAL.Printf("Measure %s produced by more than one command.", passedMeasures[i].Name)
+			return 10
+		}
+	}
+
+	log.INFO.Println(passedMeasures)
+
+	// Each command declares its own input type.
+	config.InputType = "run"
+
+	return ratchetMeasures(opts, config, passedMeasures)
+}
+
+// runMeasurement executes a measurement command with the shell, and parses the
+// measures from its output.
+func runMeasurement(command store.Command) ([]store.Measure, error) {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", command.Command)
+	} else {
+		c = exec.Command("sh", "-c", command.Command)
+	}
+
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	log.INFO.Printf("Running %s: %s", command.Name, command.Command)
+	err := c.Run()
+	if stderr.Len() > 0 {
+		log.INFO.Printf("Output of %s: %s", command.Name, stderr.String())
+	}
+
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("Error running %s: %s", command.Name, err)
+		}
+
+		exitCodes := command.ExitCodes
+		if len(exitCodes) == 0 {
+			exitCodes = []int{0}
+		}
+
+		code := exitErr.ExitCode()
+		accepted := false
+		for _, c := range exitCodes {
+			if c == code {
+				accepted = true
+			}
+		}
+
+		if !accepted {
+			return nil, fmt.Errorf("Error running %s: %s, %s", command.Name, err, stderr.String())
+		}
+	}
+
+	if command.Regex != "" {
+		return store.ParseMeasuresRegex(&stdout, command.Name, regexp.MustCompile(command.Regex))
+	}
+
+	inputType := command.InputType
+	if inputType == "" {
+		inputType = "csv"
+	}
+
+	measures, err := store.ParseMeasures(&stdout, store.ParseInputType(inputType), command.GroupBy)
+	if err != nil {
+		return nil, errors.New("Error parsing output of " + command.Name + ": " + err.Error())
+	}
+
+	for i := range measures {
+		measures[i].Name = command.Name + "." + measures[i].Name
+	}
+
+	return measures, nil
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/spf13/jwalterweatherman"
+)
+
+func TestRun(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+
+	writeConfig(t, repo, `
+commands:
+  - name: lint
+    command: printf 'errors,3\nwarnings,5\n'
+  - name: todos
+    command: printf 'a TODO\nb\nc TODO\n'
+    regex: TODO
+  - name: bundle
+    command: echo 'bundle size 1.5 MB'
+    regex: 'size ([0-9.]+) MB'
+  - name: unit
+    command: printf '<testsuite><testcase/></testsuite>'; exit 1
+    inputType: junit
+    exitCodes: [0, 1]
+`)
+
+	runRun(t, true)
+
+	dump := runDump(t, "").String()
+
+	for _, expected := range []string{"lint.errors,3,3", "lint.warnings,5,5", "todos,2,2", "bundle,1.5,1.5", "unit.tests.total,1,1"} {
+		if !strings.Contains(dump, expected) {
+			t.Fatalf("Dump incorrect. Expected %s in %s", expected, dump)
+		}
+	}
+
+	writeConfig(t, repo, `
+commands:
+  - name: lint
+    command: printf 'errors,4\nwarnings,5\n'
+  - name: todos
+    command: printf 'a TODO\nb\nc TODO\n'
+    regex: TODO
+  - name: bundle
+    command: echo 'bundle size 1.5 MB'
+    regex: 'size ([0-9.]+) MB'
+  - name: unit
+    command: printf '<testsuite><testcase/></testsuite>'
+    inputType: junit
+`)
+
+	t.Logf("Running run command w: %t", false)
+
+	errCode := Run(CheckOptions{})
+
+	if errCode != 50 {
+		t.Fatalf("Run command passed unexpectedly!")
+	}
+
+	writeConfig(t, repo, `
+commands:
+  - name: lint
+    command: exit 2
+`)
+
+	t.Logf("Running run command w: %t", false)
+
+	errCode = Run(CheckOptions{})
+
+	if errCode != 10 {
+		t.Fatalf("Run command accepted a failing command!")
+	}
+}
+
+func runRun(t *testing.T, write bool) {
+	t.Logf("Running run command w: %t", write)
+
+	errCode := Run(CheckOptions{Write: write})
+
+	if errCode != 0 {
+		t.Fatalf("Run command failed! Error code: %d", errCode)
+	}
+}
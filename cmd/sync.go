@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	log "github.com/spf13/jwalterweatherman"
+)
+
+// Sync fetches the stored measures and exclusions from the remote, merging
+// them with the local ones, then pushes the result back. Only the Prefix,
+// ConfigFile, Remote and Store options are used.
+func Sync(opts CheckOptions) int {
+	config, err := loadConfig(opts)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 10
+	}
+
+	s, err := openStore(opts, config)
+	if err != nil {
+		log.FATAL.Println(err)
+		return 20
+	}
+
+	log.INFO.Println("Fetching stored measures")
+	err = s.Fetch()
+	if err != nil {
+		log.FATAL.Println(err)
+		return 20
+	}
+
+	log.INFO.Println("Pushing stored measures")
+	err = s.Push()
+	if err != nil {
+		log.FATAL.Println(err)
+		return 70
+	}
+
+	log.INFO.Println("Finished syncing stored measures")
+	return 0
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	log "github.com/spf13/jwalterweatherman"
+)
+
+func TestSync(t *testing.T) {
+	if testing.Verbose() {
+		log.SetLogThreshold(log.LevelInfo)
+		log.SetStdoutThreshold(log.LevelInfo)
+	}
+
+	repo := createEmptyGitRepo(t)
+	remote := repo + ".git"
+	other := repo + "-other"
+
+	runCommand(t, repo, exec.Command("git", "clone", "--bare", repo, remote))
+	runCommand(t, repo, exec.Command("git", "remote", "add", "upstream", remote))
+	runCommand(t, repo, exec.Command("git", "clone", "--origin", "upstream", remote, other))
+
+	runCheck(t, true, "foo,5")
+	writeExcuse(t, "", "bar", "Later")
+
+	runSync(t, "upstream")
+
+	// A fresh clone doesn't have the notes, so checks pass against nothing.
+	os.Chdir(other)
+
+	runCheck(t, false, "foo,6")
+
+	errCode := Check(CheckOptions{Fetch: true, Remote: "upstream", InputType: "csv"}, strings.NewReader("foo,6"))
+
+	if errCode != 50 {
+		t.Fatalf("Check command passed unexpectedly!")
+	}
+
+	runCheck(t, false, "foo,5\nbar,1")
+
+	errCode = Sync(CheckOptions{})
+
+	if errCode != 20 {
+		t.Fatalf("Sync command passed with a missing remote!")
+	}
+}
+
+func runSync(t *testing.T, remote string) {
+	t.Logf("Running sync command r: %s", remote)
+
+	errCode := Sync(CheckOptions{Remote: remote})
+
+	if errCode != 0 {
+		t.Fatalf("Sync command failed! Error code: %d", errCode)
+	}
+}
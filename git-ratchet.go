@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	ratchet "github.com/iangrunert/git-ratchet/cmd"
+	"github.com/iangrunert/git-ratchet/store"
 	"github.com/spf13/cobra"
 	log "github.com/spf13/jwalterweatherman"
 	"os"
@@ -12,12 +13,40 @@ var GitTag string // Will be passed to the compiler by scripts/build.sh
 
 func main() {
 	var write bool
+	var push bool
+	var fetch bool
+	var remote string
+	var requireBaseline bool
+	var base string
+	var firstParent bool
 	var verbose bool
-	var zeroOnMissing bool
 	var prefix string
+	var inputType string
+	var groupBy []string
+	var configFile string
+	var zeroOnMissing bool
 	var slack float64
 	var usePercents bool
-	var inputType string
+	var format string
+
+	// Policy flags given on the command line override the config file.
+	overrides := func(cmd *cobra.Command) store.MeasureConfig {
+		var o store.MeasureConfig
+		if cmd.Flags().Changed("slack") {
+			o.Slack = &slack
+		}
+		if cmd.Flags().Changed("usePercents") {
+			o.UsePercents = &usePercents
+		}
+		if cmd.Flags().Changed("zero-on-missing") {
+			missing := store.MissingFail
+			if zeroOnMissing {
+				missing = store.MissingZero
+			}
+			o.Missing = &missing
+		}
+		return o
+	}
 
 	var versionCmd = &cobra.Command{
 		Use:   "version",
@@ -39,7 +68,30 @@ The most recent stored values are found by walking up the commit graph and looki
 				log.SetStdoutThreshold(log.LevelInfo)
 			}
 
-			err := ratchet.Check(prefix, slack, usePercents, write, inputType, zeroOnMissing, os.Stdin)
+			if format != "text" {
+				// Keep the log out of the report.
+				log.SetStdoutOutput(os.Stderr)
+			}
+
+			opts := ratchet.CheckOptions{
+				Prefix:          prefix,
+				Write:           write,
+				Push:            push,
+				Fetch:           fetch,
+				Remote:          remote,
+				RequireBaseline: requireBaseline,
+				Base:            base,
+				AllParents:      !firstParent,
+				ConfigFile:      configFile,
+				InputType:       inputType,
+				GroupBy:         groupBy,
+				Overrides:       overrides(cmd),
+				Format:          format,
+				Output:          os.Stdout,
+				Version:         GitTag,
+			}
+
+			err := ratchet.Check(opts, os.Stdin)
 			if err != 0 {
 				os.Exit(err)
 			}
@@ -47,13 +99,77 @@ The most recent stored values are found by walking up the commit graph and looki
 	}
 
 	checkCmd.Flags().BoolVarP(&write, "write", "w", false, "write values if no increase is detected. only use on your CI server.")
+	checkCmd.Flags().BoolVar(&push, "push", false, "push the written values, merging in values pushed by other builds.")
+	checkCmd.Flags().BoolVar(&fetch, "fetch", false, "fetch the stored values before checking.")
+	checkCmd.Flags().BoolVar(&requireBaseline, "require-baseline", false, "fail when the stored values weren't fetched, or the clone is too shallow to find them.")
+	checkCmd.Flags().StringVar(&base, "base", "", "compare against the values stored on this branch, from its merge-base with HEAD. use in pull requests.")
+	checkCmd.Flags().BoolVar(&firstParent, "first-parent", true, "only look for stored values on the first parent of merge commits.")
 	checkCmd.Flags().Float64VarP(&slack, "slack", "s", 0, "slack value, increase within the range of the slack is acceptable.")
 	checkCmd.Flags().BoolVarP(&usePercents, "usePercents", "r", false, "slack value is specified in relative percentage.")
-	checkCmd.Flags().StringVarP(&inputType, "inputType", "i", "csv", "input type. csv and checkstyle available.")
+	checkCmd.Flags().StringVarP(&inputType, "inputType", "i", "", "input type. csv, checkstyle, junit and sarif available. defaults to the config file, then csv.")
+	checkCmd.Flags().StringSliceVarP(&groupBy, "groupBy", "g", []string{}, "break the parsed measures down further. severity, source, file, dir and dir=N available for checkstyle, suite for junit.")
 	checkCmd.Flags().BoolVarP(&zeroOnMissing, "zero-on-missing", "z", false, "set measure values to zero on missing..")
+	checkCmd.Flags().StringVarP(&format, "format", "f", "text", "format of the report written to stdout. text, json, github, gitlab and markdown available.")
+	checkCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring measure policies. defaults to "+store.DefaultConfigFile+" if it exists.")
+
+	var runCmd = &cobra.Command{
+		Use:   "run",
+		Short: "Runs the measurement commands in the config file, and checks their values.",
+		Long: `Runs the measurement commands in the config file, and checks their values against the most recent stored values.
+Each command's measures are named after the command, and are checked together as if passed to the check command.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if verbose {
+				log.SetLogThreshold(log.LevelInfo)
+				log.SetStdoutThreshold(log.LevelInfo)
+			}
+
+			if format != "text" {
+				// Keep the log out of the report.
+				log.SetStdoutOutput(os.Stderr)
+			}
+
+			opts := ratchet.CheckOptions{
+				Prefix:          prefix,
+				Write:           write,
+				Push:            push,
+				Fetch:           fetch,
+				Remote:          remote,
+				RequireBaseline: requireBaseline,
+				Base:            base,
+				AllParents:      !firstParent,
+				ConfigFile:      configFile,
+				Overrides:       overrides(cmd),
+				Format:          format,
+				Output:          os.Stdout,
+				Version:         GitTag,
+			}
+
+			err := ratchet.Run(opts)
+			if err != 0 {
+				os.Exit(err)
+			}
+		},
+	}
+
+	runCmd.Flags().BoolVarP(&write, "write", "w", false, "write values if no increase is detected. only use on your CI server.")
+	runCmd.Flags().BoolVar(&push, "push", false, "push the written values, merging in values pushed by other builds.")
+	runCmd.Flags().BoolVar(&fetch, "fetch", false, "fetch the stored values before checking.")
+	runCmd.Flags().BoolVar(&requireBaseline, "require-baseline", false, "fail when the stored values weren't fetched, or the clone is too shallow to find them.")
+	runCmd.Flags().StringVar(&base, "base", "", "compare against the values stored on this branch, from its merge-base with HEAD. use in pull requests.")
+	runCmd.Flags().BoolVar(&firstParent, "first-parent", true, "only look for stored values on the first parent of merge commits.")
+	runCmd.Flags().Float64VarP(&slack, "slack", "s", 0, "slack value, increase within the range of the slack is acceptable.")
+	runCmd.Flags().BoolVarP(&usePercents, "usePercents", "r", false, "slack value is specified in relative percentage.")
+	runCmd.Flags().BoolVarP(&zeroOnMissing, "zero-on-missing", "z", false, "set measure values to zero on missing..")
+	runCmd.Flags().StringVarP(&format, "format", "f", "text", "format of the report written to stdout. text, json, github, gitlab and markdown available.")
+	runCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the measurement commands. defaults to "+store.DefaultConfigFile+".")
 
 	var measure string
 	var excuse string
+	var maxDelta float64
+	var expires string
+	var expiresAfter int
+	var excuseCommit string
+	var excuseRange string
 
 	var excuseCmd = &cobra.Command{
 		Use:   "excuse",
@@ -65,12 +181,157 @@ The most recent stored values are found by walking up the commit graph and looki
 				log.SetStdoutThreshold(log.LevelInfo)
 			}
 
-			os.Exit(ratchet.Excuse(prefix, measure, excuse))
+			opts := ratchet.CheckOptions{Prefix: prefix, ConfigFile: configFile, Remote: remote}
+
+			ex := ratchet.ExcuseOptions{Measure: measure, Excuse: excuse, Expires: expires, ExpiresAfter: expiresAfter,
+				Commit: excuseCommit, Range: excuseRange}
+			if cmd.Flags().Changed("max") {
+				ex.Max = &maxDelta
+			}
+
+			os.Exit(ratchet.Excuse(opts, ex))
 		},
 	}
 
 	excuseCmd.Flags().StringVarP(&measure, "name", "n", "", "names of the measures to excuse, comma separated list.")
 	excuseCmd.Flags().StringVarP(&excuse, "excuse", "e", "", "excuse for the measure rising.")
+	excuseCmd.Flags().Float64VarP(&maxDelta, "max", "m", 0, "most each measure may move in the wrong direction, in its units. any change is excused without it.")
+	excuseCmd.Flags().StringVar(&expires, "expires", "", "date the excuse expires, as 2006-01-02 or RFC 3339. the measure has to be back to its baseline from before by then.")
+	excuseCmd.Flags().IntVar(&expiresAfter, "expires-after", 0, "number of commits after which the excuse expires.")
+	excuseCmd.Flags().StringVar(&excuseCommit, "commit", "", "commit to write the excuse on, in place of HEAD.")
+	excuseCmd.Flags().StringVar(&excuseRange, "range", "", "range of commits to write the excuse on, as from..to like git log. to defaults to HEAD.")
+	excuseCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the store. defaults to "+store.DefaultConfigFile+" if it exists.")
+
+	var listMeasure string
+	var since string
+	var until string
+	var listFormat string
+
+	var excuseListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the excuses written.",
+		Long: `List the excuses written, most recent first, with whether they've been consumed.
+An excuse is consumed once values have been stored after it, so the next check no longer reads it.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if verbose {
+				log.SetLogThreshold(log.LevelInfo)
+				log.SetStdoutThreshold(log.LevelInfo)
+			}
+
+			opts := ratchet.CheckOptions{Prefix: prefix, ConfigFile: configFile}
+			list := ratchet.ExcuseListOptions{Measure: listMeasure, Since: since, Until: until, Format: listFormat}
+
+			os.Exit(ratchet.ListExcuses(opts, list, os.Stdout))
+		},
+	}
+
+	excuseListCmd.Flags().StringVarP(&listMeasure, "name", "n", "", "only list the excuses for the measure.")
+	excuseListCmd.Flags().StringVar(&since, "since", "", "only list the excuses on commits made since the date, as 2006-01-02 or RFC 3339.")
+	excuseListCmd.Flags().StringVar(&until, "until", "", "only list the excuses on commits made until the date, as 2006-01-02 or RFC 3339.")
+	excuseListCmd.Flags().StringVarP(&listFormat, "format", "f", "table", "format of the list. table and json available.")
+	excuseListCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the store. defaults to "+store.DefaultConfigFile+" if it exists.")
+
+	var showFormat string
+
+	var excuseShowCmd = &cobra.Command{
+		Use:   "show [commit]",
+		Short: "Show the excuse written on a commit.",
+		Long:  `Show the excuse written on a commit, HEAD by default.`,
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if verbose {
+				log.SetLogThreshold(log.LevelInfo)
+				log.SetStdoutThreshold(log.LevelInfo)
+			}
+
+			rev := "HEAD"
+			if len(args) > 0 {
+				rev = args[0]
+			}
+
+			opts := ratchet.CheckOptions{Prefix: prefix, ConfigFile: configFile}
+
+			os.Exit(ratchet.ShowExcuse(opts, rev, showFormat, os.Stdout))
+		},
+	}
+
+	excuseShowCmd.Flags().StringVarP(&showFormat, "format", "f", "text", "format of the excuse. text and json available.")
+	excuseShowCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the store. defaults to "+store.DefaultConfigFile+" if it exists.")
+
+	var selectMeasure string
+	var reason string
+
+	var excuseRevokeCmd = &cobra.Command{
+		Use:   "revoke [commit]",
+		Short: "Revoke the excuse written on a commit.",
+		Long: `Revoke the excuse written on a commit, HEAD by default, so it no longer allows the check to pass.
+The excuse is kept, marked with who revoked it and why.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if verbose {
+				log.SetLogThreshold(log.LevelInfo)
+				log.SetStdoutThreshold(log.LevelInfo)
+			}
+
+			opts := ratchet.CheckOptions{Prefix: prefix, ConfigFile: configFile, Remote: remote}
+			sel := ratchet.ExcuseSelector{Measure: selectMeasure}
+			if len(args) > 0 {
+				sel.Commit = args[0]
+			}
+
+			os.Exit(ratchet.RevokeExcuse(opts, sel, reason))
+		},
+	}
+
+	excuseRevokeCmd.Flags().StringVarP(&selectMeasure, "name", "n", "", "only revoke the excuses for the measure, of several on the commit.")
+	excuseRevokeCmd.Flags().StringVarP(&reason, "reason", "r", "", "reason for revoking the excuse.")
+	excuseRevokeCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the store. defaults to "+store.DefaultConfigFile+" if it exists.")
+
+	var noMax bool
+	var noExpiry bool
+
+	var excuseAmendCmd = &cobra.Command{
+		Use:   "amend [commit]",
+		Short: "Amend the excuse written on a commit.",
+		Long: `Amend the excuse written on a commit, HEAD by default, changing its text, maximum or expiry.
+The excuse is replaced by the amended one, and kept marked with who amended it and why.
+Pass --no-max or --no-expiry to drop the maximum or expiry.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if verbose {
+				log.SetLogThreshold(log.LevelInfo)
+				log.SetStdoutThreshold(log.LevelInfo)
+			}
+
+			opts := ratchet.CheckOptions{Prefix: prefix, ConfigFile: configFile, Remote: remote}
+			sel := ratchet.ExcuseSelector{Measure: selectMeasure}
+			if len(args) > 0 {
+				sel.Commit = args[0]
+			}
+
+			ex := ratchet.ExcuseOptions{Excuse: excuse, Expires: expires, ExpiresAfter: expiresAfter, NoMax: noMax, NoExpiry: noExpiry}
+			if cmd.Flags().Changed("max") {
+				ex.Max = &maxDelta
+			}
+
+			os.Exit(ratchet.AmendExcuse(opts, sel, ex, reason))
+		},
+	}
+
+	excuseAmendCmd.Flags().StringVarP(&selectMeasure, "name", "n", "", "amend the excuse for the measure, of several on the commit.")
+	excuseAmendCmd.Flags().StringVarP(&reason, "reason", "r", "", "reason for amending the excuse.")
+	excuseAmendCmd.Flags().StringVarP(&excuse, "excuse", "e", "", "new excuse for the measure rising.")
+	excuseAmendCmd.Flags().Float64VarP(&maxDelta, "max", "m", 0, "new most each measure may move in the wrong direction, in its units.")
+	excuseAmendCmd.Flags().StringVar(&expires, "expires", "", "new date the excuse expires, as 2006-01-02 or RFC 3339.")
+	excuseAmendCmd.Flags().IntVar(&expiresAfter, "expires-after", 0, "new number of commits after which the excuse expires.")
+	excuseAmendCmd.Flags().BoolVar(&noMax, "no-max", false, "drop the maximum, excusing any change.")
+	excuseAmendCmd.Flags().BoolVar(&noExpiry, "no-expiry", false, "drop the expiry date and number of commits.")
+	excuseAmendCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the store. defaults to "+store.DefaultConfigFile+" if it exists.")
+
+	excuseCmd.AddCommand(excuseListCmd, excuseShowCmd, excuseRevokeCmd, excuseAmendCmd)
+
+	// Dump shows every parent by default, unlike check.
+	var mainline bool
 
 	var dumpCmd = &cobra.Command{
 		Use:   "dump",
@@ -82,7 +343,9 @@ The most recent stored values are found by walking up the commit graph and looki
 				log.SetStdoutThreshold(log.LevelInfo)
 			}
 
-			err := ratchet.Dump(prefix, os.Stdout)
+			opts := ratchet.CheckOptions{Prefix: prefix, ConfigFile: configFile, AllParents: !mainline}
+
+			err := ratchet.Dump(opts, os.Stdout)
 
 			if err != 0 {
 				os.Exit(err)
@@ -90,10 +353,74 @@ The most recent stored values are found by walking up the commit graph and looki
 		},
 	}
 
+	dumpCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the store. defaults to "+store.DefaultConfigFile+" if it exists.")
+	dumpCmd.Flags().BoolVar(&mainline, "first-parent", false, "only show values stored on the first parent of merge commits, the mainline history.")
+
+	var syncCmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Fetch and push the stored values.",
+		Long: `Fetch the stored values and excuses from the remote, merging them with the local ones, then push the result back.
+Run it on a fresh clone before checking, as a default clone doesn't fetch the git notes the values are stored in.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if verbose {
+				log.SetLogThreshold(log.LevelInfo)
+				log.SetStdoutThreshold(log.LevelInfo)
+			}
+
+			opts := ratchet.CheckOptions{Prefix: prefix, ConfigFile: configFile, Remote: remote}
+
+			err := ratchet.Sync(opts)
+			if err != 0 {
+				os.Exit(err)
+			}
+		},
+	}
+
+	syncCmd.Flags().StringVarP(&configFile, "config", "c", "", "config file declaring the store. defaults to "+store.DefaultConfigFile+" if it exists.")
+
+	var dryRun bool
+	var verify bool
+	var rollback bool
+
+	var migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Convert the stored measures to the current note format.",
+		Long: `Convert the measures stored in version 1 notes to version 2 notes, then verify them.
+If the verification fails the migration is rolled back. The version 1 notes are kept.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if verbose {
+				log.SetLogThreshold(log.LevelInfo)
+				log.SetStdoutThreshold(log.LevelInfo)
+			}
+
+			var err int
+			switch {
+			case verify && rollback:
+				log.FATAL.Println("Pass only one of --verify and --rollback.")
+				err = 10
+			case verify:
+				err = ratchet.VerifyMigration(prefix)
+			case rollback:
+				err = ratchet.RollbackMigration(prefix)
+			default:
+				err = ratchet.Migrate(prefix, GitTag, dryRun)
+			}
+
+			if err != 0 {
+				os.Exit(err)
+			}
+		},
+	}
+
+	migrateCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "count the notes to migrate without writing them.")
+	migrateCmd.Flags().BoolVar(&verify, "verify", false, "check every note has been migrated, without migrating.")
+	migrateCmd.Flags().BoolVar(&rollback, "rollback", false, "remove the migrated notes.")
+
 	var rootCmd = &cobra.Command{Use: "git-ratchet"}
-	rootCmd.AddCommand(checkCmd, excuseCmd, dumpCmd, versionCmd)
+	rootCmd.AddCommand(checkCmd, runCmd, excuseCmd, dumpCmd, syncCmd, migrateCmd, versionCmd)
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "increase logging verbosity.")
 	rootCmd.PersistentFlags().StringVarP(&prefix, "prefix", "p", "master", "prefix the ratchet notes. useful for storing multiple sets of values in the same repo.")
+	rootCmd.PersistentFlags().StringVar(&remote, "remote", "", "remote the ratchet notes are fetched from and pushed to. defaults to the config file, then origin.")
 
 	rootCmd.Execute()
 }
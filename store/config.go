@@ -0,0 +1,243 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultConfigFile is the repository config file read by check when no other
+// file is given.
+const DefaultConfigFile = ".git-ratchet.yml"
+
+// Missing is what happens when a stored measure isn't passed to check.
+type Missing int
+
+const (
+	// MissingFail fails the check. This is the default.
+	MissingFail Missing = iota
+	// MissingZero stores the measure as zero.
+	MissingZero
+	// MissingIgnore drops the measure without failing.
+	MissingIgnore
+)
+
+// MeasureConfig is the policy for a measure, as declared in the config file.
+// Fields left unset are inherited from the top level of the config file, and
+// failing that take their defaults.
+type MeasureConfig struct {
+	Slack       *float64   `yaml:"slack"`
+	UsePercents *bool      `yaml:"usePercents"`
+	Direction   *Direction `yaml:"direction"`
+	Missing     *Missing   `yaml:"missing"`
+	// Unit is recorded alongside the measure, like ms or MB.
+	Unit *string `yaml:"unit"`
+}
+
+// Config is the repository config file, which versions the ratchet policies
+// alongside the code.
+//
+//	inputType: checkstyle
+//	groupBy: [severity]
+//	slack: 0
+//	measures:
+//	  coverage:
+//	    direction: higher
+//	    slack: 0.5
+//	  errors.severity.*:
+//	    missing: zero
+//
+// Measure names may be patterns, where * stands for any run of characters and
+// ? for any single character. When several patterns match a measure the
+// longest pattern wins, and an exact name always wins.
+type Config struct {
+	InputType     string   `yaml:"inputType"`
+	GroupBy       []string `yaml:"groupBy"`
+	MeasureConfig `yaml:",inline"`
+	Measures      map[string]MeasureConfig `yaml:"measures"`
+	Commands      []Command                `yaml:"commands"`
+	Store         StoreConfig              `yaml:"store"`
+	// Overrides take precedence over everything in the config file. They hold
+	// the policy flags given on the command line.
+	Overrides MeasureConfig `yaml:"-"`
+}
+
+// Command is a measurement command, executed by git ratchet run. Its output
+// is parsed according to InputType and GroupBy, and each measure is named
+// <name>.<measure>. When Regex is set the output is matched against it
+// instead, see ParseMeasuresRegex.
+type Command struct {
+	Name      string   `yaml:"name"`
+	Command   string   `yaml:"command"`
+	InputType string   `yaml:"inputType"`
+	GroupBy   []string `yaml:"groupBy"`
+	Regex     string   `yaml:"regex"`
+	// ExitCodes are the exit codes which mean the command ran successfully.
+	// Defaults to 0 only, but many linters exit with 1 when they find problems.
+	ExitCodes []int `yaml:"exitCodes"`
+}
+
+// Policy is the resolved policy for a single measure.
+type Policy struct {
+	Slack       float64
+	UsePercents bool
+	Missing     Missing
+	Unit        string
+}
+
+// LoadConfig reads the config file at path. A missing file gives the default
+// config, unless required is set.
+func LoadConfig(path string, required bool) (Config, error) {
+	var c Config
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	err = yaml.UnmarshalStrict(data, &c)
+	if err != nil {
+		return c, errors.New("Error reading config " + path + ": " + err.Error())
+	}
+
+	names := make(map[string]bool)
+	for _, command := range c.Commands {
+		if command.Name == "" || command.Command == "" {
+			return c, errors.New("Error reading config " + path + ": commands need a name and a command")
+		}
+		if names[command.Name] {
+			return c, errors.New("Error reading config " + path + ": duplicate command " + command.Name)
+		}
+		names[command.Name] = true
+
+		if command.Regex != "" {
+			if _, err := regexp.Compile(command.Regex); err != nil {
+				return c, errors.New("Error reading config " + path + ": bad regex for command " + command.Name + ": " + err.Error())
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// PolicyFor resolves the policy for the named measure.
+func (c Config) PolicyFor(name string) Policy {
+	m := c.merged(name)
+
+	var p Policy
+	if m.Slack != nil {
+		p.Slack = *m.Slack
+	}
+	if m.UsePercents != nil {
+		p.UsePercents = *m.UsePercents
+	}
+	if m.Missing != nil {
+		p.Missing = *m.Missing
+	}
+	if m.Unit != nil {
+		p.Unit = *m.Unit
+	}
+	return p
+}
+
+// ApplyDirections sets the direction of each measure which has one declared in
+// the config, overriding the direction passed in the input.
+func (c Config) ApplyDirections(measures []Measure) {
+	for i := range measures {
+		if d := c.merged(measures[i].Name).Direction; d != nil {
+			measures[i].Direction = *d
+		}
+	}
+}
+
+func (c Config) merged(name string) MeasureConfig {
+	m := c.MeasureConfig
+
+	patterns := make([]string, 0, len(c.Measures))
+	for pattern := range c.Measures {
+		if pattern != name && matchMeasure(pattern, name) {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	// Apply the least specific patterns first, so more specific ones win.
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) < len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	for _, pattern := range patterns {
+		m = m.overlay(c.Measures[pattern])
+	}
+
+	if exact, ok := c.Measures[name]; ok {
+		m = m.overlay(exact)
+	}
+
+	return m.overlay(c.Overrides)
+}
+
+// overlay returns m with every field set in o replaced.
+func (m MeasureConfig) overlay(o MeasureConfig) MeasureConfig {
+	if o.Slack != nil {
+		m.Slack = o.Slack
+	}
+	if o.UsePercents != nil {
+		m.UsePercents = o.UsePercents
+	}
+	if o.Direction != nil {
+		m.Direction = o.Direction
+	}
+	if o.Missing != nil {
+		m.Missing = o.Missing
+	}
+	if o.Unit != nil {
+		m.Unit = o.Unit
+	}
+	return m
+}
+
+// matchMeasure reports whether the measure name matches pattern, where * stands
+// for any run of characters and ? for any single character.
+func matchMeasure(pattern string, name string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+
+	return regexp.MustCompile("^" + expr + "$").MatchString(name)
+}
+
+// ParseMissing parses the behaviour for missing measures: fail, zero or ignore.
+func ParseMissing(s string) (Missing, error) {
+	switch s {
+	case "fail":
+		return MissingFail, nil
+	case "zero":
+		return MissingZero, nil
+	case "ignore":
+		return MissingIgnore, nil
+	default:
+		return MissingFail, errors.New("Unknown missing measure behaviour: " + s)
+	}
+}
+
+func (m *Missing) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+
+	*m, err = ParseMissing(s)
+	return err
+}
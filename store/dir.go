@@ -0,0 +1,220 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// DirStore keeps measures and exclusions as JSON files in a directory, named
+// after the commit they were written on, for teams who can't push git notes.
+// The directory can be kept in a CI cache or artifact store. The history is
+// still read from the git repository.
+type DirStore struct {
+	Dir string
+}
+
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{Dir: dir}
+}
+
+func (s *DirStore) path(kind string, commit plumbing.Hash) string {
+	return filepath.Join(s.Dir, kind, commit.String()+".json")
+}
+
+// read decodes the file for the commit into v, leaving v alone if there isn't
+// one.
+func (s *DirStore) read(kind string, commit plumbing.Hash, v interface{}) error {
+	data, err := ioutil.ReadFile(s.path(kind, commit))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// write encodes v into the file for HEAD.
+func (s *DirStore) write(kind string, v interface{}) error {
+	head, err := headHash()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(kind, head, data)
+}
+
+// writeFile writes the file for the commit. It's written alongside and renamed
+// into place, so readers never see it half written.
+func (s *DirStore) writeFile(kind string, commit plumbing.Hash, data []byte) error {
+	path := s.path(kind, commit)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// CommitMeasures walks the history for stored measures. There's nothing to
+// fetch into the directory, so finding none means none have been stored.
+func (s *DirStore) CommitMeasures(opts HistoryOptions) (func() (CommitMeasure, error), error) {
+	return historyMeasures(opts, true, func(commit plumbing.Hash) ([]Measure, error) {
+		var note Note
+		err := s.read("measures", commit, &note)
+		return note.StoredMeasures(), err
+	})
+}
+
+func (s *DirStore) PutMeasures(m []Measure, info RunInfo) error {
+	head, err := headHash()
+	if err != nil {
+		return err
+	}
+
+	exclusions, err := s.readExclusions(head)
+	if err != nil {
+		return err
+	}
+
+	note := NewNote(m, info)
+	note.Excuses = exclusionIDs(exclusions)
+
+	return s.write("measures", note)
+}
+
+func (s *DirStore) Exclusions(hash string) ([]Exclusion, error) {
+	var note Note
+	err := s.read("measures", plumbing.NewHash(hash), &note)
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	exclusions, err := historyExclusions(hash, s.readExclusions)
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	return unusedExclusions(exclusions, note.Excuses), nil
+}
+
+func (s *DirStore) ListExclusions() ([]Exclusion, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.Dir, "excuses"))
+	if err != nil && !os.IsNotExist(err) {
+		return []Exclusion{}, err
+	}
+
+	commits := make([]plumbing.Hash, 0, len(files))
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".json")
+		if name != f.Name() && plumbing.IsHash(name) {
+			commits = append(commits, plumbing.NewHash(name))
+		}
+	}
+
+	return listExclusions(commits, s.readExclusions)
+}
+
+func (s *DirStore) readExclusions(commit plumbing.Hash) ([]Exclusion, error) {
+	data, err := ioutil.ReadFile(s.path("excuses", commit))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseExclusions(string(data))
+}
+
+func (s *DirStore) PutExclusion(ex Exclusion) error {
+	head, err := headHash()
+	if err != nil {
+		return err
+	}
+
+	return s.UpdateExclusions([]string{head.String()}, AppendExclusion(ex))
+}
+
+// UpdateExclusions isn't safe against concurrent writers, unlike the git
+// store, as excuses are written by hand.
+func (s *DirStore) UpdateExclusions(hashes []string, update func(hash string, exclusions []Exclusion) ([]Exclusion, error)) error {
+	for _, hash := range hashes {
+		commit := plumbing.NewHash(hash)
+
+		exclusions, err := s.readExclusions(commit)
+		if err != nil {
+			return err
+		}
+
+		exclusions, err = update(hash, exclusions)
+		if err != nil {
+			return err
+		}
+
+		if len(exclusions) == 0 {
+			err = os.Remove(s.path("excuses", commit))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		var b bytes.Buffer
+		err = WriteExclusions(exclusions, &b)
+		if err != nil {
+			return err
+		}
+
+		err = s.writeFile("excuses", commit, b.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *DirStore) CommitsSince(hash string) (int, error) {
+	return commitsSince(hash)
+}
+
+func (s *DirStore) Reaches(hash string, commit string) (bool, error) {
+	return reaches(hash, commit)
+}
+
+// Fetch does nothing, the directory is shared however the team chooses.
+func (s *DirStore) Fetch() error {
+	return nil
+}
+
+// Push does nothing, the directory is shared however the team chooses.
+func (s *DirStore) Push() error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// NoteVersion is the version of the note format written by PutMeasures.
+// Version 1 notes are bare name,value,baseline CSV, see WriteMeasures.
+const NoteVersion = 2
+
+// Note is the version 2 note format. Alongside the measures, it records how
+// they were produced.
+type Note struct {
+	Version int `json:"version"`
+	// Tool is the version of git-ratchet which wrote the note.
+	Tool      string    `json:"tool,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Build     *Build    `json:"build,omitempty"`
+	// InputType is how the measures were read, or run for the measures of
+	// the measurement commands.
+	InputType string `json:"inputType,omitempty"`
+	// MigratedFrom is the version of the note this note was converted from, by
+	// git ratchet migrate.
+	MigratedFrom int `json:"migratedFrom,omitempty"`
+	// Excuses are the IDs of the excuses on the commit when the note was
+	// written. The check writing the note has used them, so later checks
+	// don't read them again.
+	Excuses  []string      `json:"excuses,omitempty"`
+	Measures []NoteMeasure `json:"measures"`
+}
+
+// NoteMeasure is a measure stored in a note, with the policy it was checked
+// against.
+type NoteMeasure struct {
+	Measure
+	Unit        string  `json:"unit,omitempty"`
+	Slack       float64 `json:"slack"`
+	UsePercents bool    `json:"usePercents"`
+}
+
+// Build identifies the CI build which wrote a note.
+type Build struct {
+	ID  string `json:"id,omitempty"`
+	URL string `json:"url,omitempty"`
+}
+
+// RunInfo describes the run storing measures, for the note.
+type RunInfo struct {
+	Tool      string
+	Build     *Build
+	InputType string
+	// Policies are the policies the measures were checked against, by name.
+	Policies map[string]Policy
+}
+
+// NewNote builds the note for the measures.
+func NewNote(measures []Measure, info RunInfo) Note {
+	note := Note{Version: NoteVersion,
+		Tool:      info.Tool,
+		Timestamp: time.Now().UTC(),
+		Build:     info.Build,
+		InputType: info.InputType,
+		Measures:  make([]NoteMeasure, 0, len(measures))}
+
+	sort.Sort(ByName(measures))
+	for _, m := range measures {
+		p := info.Policies[m.Name]
+		note.Measures = append(note.Measures, NoteMeasure{Measure: m, Unit: p.Unit, Slack: p.Slack, UsePercents: p.UsePercents})
+	}
+
+	return note
+}
+
+// StoredMeasures returns the measures in the note.
+func (n Note) StoredMeasures() []Measure {
+	measures := make([]Measure, 0, len(n.Measures))
+	for _, m := range n.Measures {
+		measures = append(measures, m.Measure)
+	}
+	return measures
+}
+
+func WriteNote(note Note, w io.Writer) error {
+	return json.NewEncoder(w).Encode(note)
+}
+
+func ParseNote(r io.Reader) (Note, error) {
+	var note Note
+	err := json.NewDecoder(r).Decode(&note)
+	if err != nil {
+		return note, err
+	}
+
+	// Later versions may change what the fields mean, so reading them as
+	// version 2 could ratchet against the wrong baseline.
+	if note.Version != NoteVersion {
+		return note, fmt.Errorf("Unsupported note version %d, this version of git-ratchet reads version %d", note.Version, NoteVersion)
+	}
+
+	return note, nil
+}
+
+// CIBuild identifies the CI build from the environment of the common CI
+// services, or returns nil outside of CI.
+func CIBuild() *Build {
+	env := os.Getenv
+
+	switch {
+	case env("GITHUB_ACTIONS") == "true":
+		return &Build{ID: env("GITHUB_RUN_ID"),
+			URL: env("GITHUB_SERVER_URL") + "/" + env("GITHUB_REPOSITORY") + "/actions/runs/" + env("GITHUB_RUN_ID")}
+	case env("GITLAB_CI") == "true":
+		return &Build{ID: env("CI_JOB_ID"), URL: env("CI_JOB_URL")}
+	case env("CIRCLECI") == "true":
+		return &Build{ID: env("CIRCLE_BUILD_NUM"), URL: env("CIRCLE_BUILD_URL")}
+	case env("TRAVIS") == "true":
+		return &Build{ID: env("TRAVIS_BUILD_ID"), URL: env("TRAVIS_BUILD_WEB_URL")}
+	case env("BUILDKITE") == "true":
+		return &Build{ID: env("BUILDKITE_BUILD_ID"), URL: env("BUILDKITE_BUILD_URL")}
+	case env("JENKINS_URL") != "":
+		return &Build{ID: env("BUILD_TAG"), URL: env("BUILD_URL")}
+	default:
+		return nil
+	}
+}
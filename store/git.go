@@ -1,75 +1,860 @@
 package store
 
 import (
+	"errors"
 	"fmt"
-	log "github.com/spf13/jwalterweatherman"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	log "github.com/spf13/jwalterweatherman"
 )
 
-func GitLog(ref string, commitrange string, format string) *exec.Cmd {
-	gitlog := exec.Command("git", "--no-pager", "log", "--notes="+ref, `--pretty=format:'`+format+`'`, commitrange)
-	log.INFO.Println(strings.Join(gitlog.Args, " "))
-	return gitlog
+// OpenRepository opens the git repository containing the working directory.
+func OpenRepository() (*git.Repository, error) {
+	repo, err := git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening git repository %s", err)
+	}
+	return repo, nil
 }
 
-func GetCommitterName() (string, error) {
-	getname := exec.Command("git", "config", "--get", "user.name")
+// RepositoryRoot returns the root of the worktree containing the working
+// directory, or the working directory itself when it isn't inside one.
+func RepositoryRoot() (string, error) {
+	if repo, err := OpenRepository(); err == nil {
+		if wt, err := repo.Worktree(); err == nil {
+			return wt.Filesystem.Root(), nil
+		}
+	}
+	return os.Getwd()
+}
+
+func notesRefName(ref string) plumbing.ReferenceName {
+	return plumbing.ReferenceName("refs/notes/" + ref)
+}
+
+// Notes are the notes stored under a notes ref, keyed by the hash of the
+// commit they annotate.
+type Notes struct {
+	repo  *git.Repository
+	ref   *plumbing.Reference
+	blobs map[plumbing.Hash]plumbing.Hash
+	// others are the entries in the notes tree which aren't notes.
+	others  []object.TreeEntry
+	changed bool
+	// merged is the notes commit merged in, the second parent of the next
+	// commit.
+	merged plumbing.Hash
+	// forward is the notes commit to fast forward the ref to, instead of
+	// making a new commit.
+	forward plumbing.Hash
+}
+
+// ReadNotes reads the notes stored under refs/notes/<ref>. A ref which
+// doesn't exist holds no notes.
+func ReadNotes(repo *git.Repository, ref string) (*Notes, error) {
+	// Refs are rewritten in place, so wait for any writer to finish. Nobody
+	// can write notes to a repository we can't create the lock file in, like
+	// a read-only checkout, so that is read without the lock.
+	unlock, err := lockRepository(repo)
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS) {
+		log.INFO.Printf("Reading %s without locking the repository: %s", notesRefName(ref), err)
+		return readNotes(repo, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return readNotes(repo, ref)
+}
+
+// readNotes reads the notes, with the repository already locked.
+func readNotes(repo *git.Repository, ref string) (*Notes, error) {
+	notes := &Notes{repo: repo, blobs: make(map[plumbing.Hash]plumbing.Hash)}
+
+	r, err := repo.Reference(notesRefName(ref), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return notes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	notes.ref = r
+
+	notes.blobs, notes.others, err = readNotesCommit(repo, r.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+// readNotesCommit reads the notes in a notes commit, giving the blob holding
+// the note on each annotated commit, and the other entries at the top of its
+// tree.
+func readNotesCommit(repo *git.Repository, hash plumbing.Hash) (map[plumbing.Hash]plumbing.Hash, []object.TreeEntry, error) {
+	blobs := make(map[plumbing.Hash]plumbing.Hash)
+
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Anything in the tree which isn't a note, or a directory of them, was
+	// put there by someone else and is kept as it is.
+	var others []object.TreeEntry
+	for _, e := range tree.Entries {
+		if !isHex(e.Name) {
+			others = append(others, e)
+		}
+	}
+
+	// Notes may be fanned out into directories, like ab/cdef..., so the path
+	// without slashes is the annotated commit hash.
+	err = tree.Files().ForEach(func(f *object.File) error {
+		name := strings.Replace(f.Name, "/", "", -1)
+		if len(name) == 40 && isHex(name) {
+			blobs[plumbing.NewHash(name)] = f.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return blobs, others, nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// Exists reports whether the notes ref exists.
+func (n *Notes) Exists() bool {
+	return n.ref != nil
+}
+
+// Note returns the note on a commit, or an empty string if there is none.
+func (n *Notes) Note(commit plumbing.Hash) (string, error) {
+	blobHash, ok := n.blobs[commit]
+	if !ok {
+		return "", nil
+	}
+
+	blob, err := n.repo.BlobObject(blobHash)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+// Commits returns the commits with a note, in hash order.
+func (n *Notes) Commits() []plumbing.Hash {
+	commits := make([]plumbing.Hash, 0, len(n.blobs))
+	for commit := range n.blobs {
+		commits = append(commits, commit)
+	}
+	sort.Slice(commits, func(i, j int) bool { return commits[i].String() < commits[j].String() })
+	return commits
+}
+
+// SetNote replaces the note on a commit. The change is kept in memory until
+// committed by UpdateNotes.
+func (n *Notes) SetNote(commit plumbing.Hash, note string) error {
+	blob, err := writeObject(n.repo, plumbing.BlobObject, func(w io.Writer) error {
+		_, err := io.WriteString(w, note)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-	name, err := getname.CombinedOutput()
+	n.set(commit, blob)
+	return nil
+}
+
+// RemoveNote removes the note on a commit. The change is kept in memory until
+// committed by UpdateNotes.
+func (n *Notes) RemoveNote(commit plumbing.Hash) {
+	if _, ok := n.blobs[commit]; ok {
+		delete(n.blobs, commit)
+		n.changed = true
+	}
+}
+
+func (n *Notes) set(commit plumbing.Hash, blob plumbing.Hash) {
+	n.blobs[commit] = blob
+	n.changed = true
+}
+
+// signature is the identity notes are written with, taken from the git config.
+func signature(repo *git.Repository) object.Signature {
+	sig := object.Signature{Name: "git-ratchet", When: time.Now()}
+
+	cfg, err := repo.ConfigScoped(config.SystemScope)
+	if err == nil {
+		if cfg.User.Name != "" {
+			sig.Name = cfg.User.Name
+		}
+		sig.Email = cfg.User.Email
+	}
 
+	return sig
+}
+
+func GetCommitterName() (string, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return "", err
+	}
+
+	cfg, err := repo.ConfigScoped(config.SystemScope)
 	if err != nil {
-		log.ERROR.Printf("Get committer name failed %s : %s", err, name)
+		log.ERROR.Printf("Get committer name failed %s", err)
 		return "", err
 	}
 
-	return strings.Trim(string(name), "\n"), nil
+	if cfg.User.Name == "" {
+		log.ERROR.Println("Get committer name failed, user.name is not set")
+		return "", errors.New("user.name is not set in the git config")
+	}
+
+	return cfg.User.Name, nil
 }
 
+// maxNoteAttempts bounds the retries when another writer moves the notes ref
+// while a note is being written.
+const maxNoteAttempts = 5
+
+// WriteNotes writes the note produced by writef on HEAD, under
+// refs/notes/<ref>, replacing any note already there. Nothing is written to the
+// working tree, and concurrent writers each add their note in turn.
 func WriteNotes(writef func(io.Writer) error, ref string) error {
-	// Create a temporary file to store the note data
-	notepath := ".git-ratchet-note"
+	repo, err := OpenRepository()
+	if err != nil {
+		return err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("Error writing notes %s", err)
+	}
+
+	log.INFO.Printf("Writing note on %s under %s", head.Hash(), notesRefName(ref))
+
+	blob, err := writeObject(repo, plumbing.BlobObject, writef)
+	if err != nil {
+		return fmt.Errorf("Error writing notes %s", err)
+	}
+
+	err = UpdateNotes(repo, ref, "Notes added by 'git ratchet'", func(notes *Notes) error {
+		notes.set(head.Hash(), blob)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing notes %s", err)
+	}
+
+	return nil
+}
+
+// UpdateNotes applies update to the notes under refs/notes/<ref>, and commits
+// any changes it makes with the message. If another writer moves the ref in
+// the meantime, update is applied again to the new notes.
+func UpdateNotes(repo *git.Repository, ref string, message string, update func(notes *Notes) error) error {
+	unlock, err := lockRepository(repo)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		notes, err := readNotes(repo, ref)
+		if err != nil {
+			return err
+		}
+
+		err = update(notes)
+		if err != nil {
+			return err
+		}
+
+		if !notes.changed {
+			return nil
+		}
+
+		err = notes.commit(ref, message)
+		if err == storage.ErrReferenceHasChanged && attempt < maxNoteAttempts {
+			log.INFO.Printf("%s changed while writing, retrying", notesRefName(ref))
+			continue
+		}
+
+		return err
+	}
+}
+
+// lockRepository serialises the ratchet commands writing notes to the
+// repository at the same time. The lock is released by the returned function,
+// or by the operating system if the process is killed.
+func lockRepository(repo *git.Repository) (func(), error) {
+	fs, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return func() {}, nil
+	}
+
+	f, err := fs.Filesystem().OpenFile("git-ratchet.lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Lock()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		f.Unlock()
+		f.Close()
+	}, nil
+}
+
+// commit writes the notes as a new commit on top of the notes ref.
+func (n *Notes) commit(ref string, message string) error {
+	if !n.forward.IsZero() {
+		return n.setRef(ref, n.forward)
+	}
+
+	entries := make([]object.TreeEntry, 0, len(n.blobs)+len(n.others))
+	for commit, blob := range n.blobs {
+		entries = append(entries, object.TreeEntry{Name: commit.String(), Mode: filemode.Regular, Hash: blob})
+	}
+	entries = append(entries, n.others...)
+
+	// git sorts directories as though their names end in a slash.
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool { return key(entries[i]) < key(entries[j]) })
+
+	obj := n.repo.Storer.NewEncodedObject()
+	err := (&object.Tree{Entries: entries}).Encode(obj)
+	if err != nil {
+		return err
+	}
+
+	tree, err := n.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
 
-	tempfile, err := os.Create(notepath)
+	sig := signature(n.repo)
+	c := &object.Commit{Author: sig, Committer: sig, Message: message, TreeHash: tree}
+	if n.ref != nil {
+		c.ParentHashes = []plumbing.Hash{n.ref.Hash()}
+	}
+	if !n.merged.IsZero() {
+		c.ParentHashes = append(c.ParentHashes, n.merged)
+	}
+
+	obj = n.repo.Storer.NewEncodedObject()
+	err = c.Encode(obj)
+	if err != nil {
+		return err
+	}
+
+	hash, err := n.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+
+	return n.setRef(ref, hash)
+}
+
+// setRef moves the notes ref to the notes commit, if nobody else has moved it
+// since the notes were read.
+func (n *Notes) setRef(ref string, hash plumbing.Hash) error {
+	newRef := plumbing.NewHashReference(notesRefName(ref), hash)
+
+	err := n.unpackRef()
+	if err != nil {
+		return err
+	}
+
+	err = n.repo.Storer.CheckAndSetReference(newRef, n.ref)
+	if err != nil {
+		return err
+	}
+
+	n.ref = newRef
+	n.changed = false
+	n.merged = plumbing.ZeroHash
+	n.forward = plumbing.ZeroHash
+	return nil
+}
+
+// unpackRef writes the notes ref as a loose ref, when git gc has moved it into
+// packed-refs. go-git compares the old value against the loose ref only, and
+// otherwise leaves an empty loose ref behind. Writers hold the repository
+// lock, so the ref can't move in the meantime.
+func (n *Notes) unpackRef() error {
+	fs, ok := n.repo.Storer.(*filesystem.Storage)
+	if !ok || n.ref == nil {
+		return nil
+	}
+
+	_, err := fs.Filesystem().Stat(n.ref.Name().String())
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	return n.repo.Storer.SetReference(n.ref)
+}
+
+func writeObject(repo *git.Repository, t plumbing.ObjectType, writef func(io.Writer) error) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(t)
+
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	err = writef(w)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+// MergeFunc merges two notes on the same commit, ours from the local notes
+// ref and theirs from the remote.
+type MergeFunc func(ours string, theirs string) (string, error)
+
+// maxPushAttempts bounds the rounds of fetching, merging and pushing when
+// other writers keep pushing notes to the remote.
+const maxPushAttempts = 5
+
+// PushNotes pushes refs/notes/<ref> to the remote. When the push is rejected,
+// say because another CI job pushed notes first, the remote notes are fetched
+// and merged into the local ref with merge, and the push is tried again.
+func PushNotes(remote string, ref string, merge MergeFunc) error {
+	repo, err := OpenRepository()
+	if err != nil {
+		return err
+	}
+
+	refspec := notesRefName(ref).String() + ":" + notesRefName(ref).String()
+
+	for attempt := 1; ; attempt++ {
+		log.INFO.Printf("Pushing %s to %s", refspec, remote)
+
+		err = runGit("push", "--porcelain", remote, refspec)
+		if err == nil {
+			return nil
+		}
+		// Only a push rejected because the remote ref moved on is fixed by
+		// merging. Anything else, like bad credentials, fails straight away.
+		if !strings.Contains(err.Error(), "[rejected]") || attempt == maxPushAttempts {
+			return fmt.Errorf("Error pushing notes %s", err)
+		}
+
+		log.INFO.Printf("Push of %s rejected, merging the remote notes: %s", notesRefName(ref), err)
+
+		err = FetchNotes(repo, remote, ref, merge)
+		if err != nil {
+			return fmt.Errorf("Error pushing notes %s", err)
+		}
+	}
+}
+
+// hasRemote reports whether the remote could hold notes which haven't been
+// fetched. A remote given as a URL or path always could.
+func hasRemote(repo *git.Repository, remote string) bool {
+	_, err := repo.Remote(remote)
+	return err != git.ErrRemoteNotFound || strings.ContainsAny(remote, "/:")
+}
+
+// FetchNotes fetches refs/notes/<ref> from the remote, and merges it into the
+// local ref with merge. The remote not having the ref is fine.
+func FetchNotes(repo *git.Repository, remote string, ref string, merge MergeFunc) error {
+	tracking := plumbing.ReferenceName("refs/git-ratchet/remotes/" + remote + "/" + ref)
+	refspec := "+" + notesRefName(ref).String() + ":" + tracking.String()
+
+	log.INFO.Printf("Fetching %s from %s", refspec, remote)
+
+	err := runGit("fetch", "--no-tags", remote, refspec)
+	if err != nil && strings.Contains(err.Error(), "couldn't find remote ref") {
+		log.INFO.Printf("No %s on %s", notesRefName(ref), remote)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// git may have written a new pack, which an open repository doesn't
+	// know about yet.
+	if fs, ok := repo.Storer.(*filesystem.Storage); ok {
+		fs.Reindex()
+	}
+
+	theirs, err := repo.Reference(tracking, true)
+	if err != nil {
+		return err
+	}
+
+	return MergeNotes(repo, ref, theirs.Hash(), merge)
+}
+
+// runGit runs git for talking to remotes, so the user's credential helpers,
+// ssh config and http settings are all honoured. The error holds git's
+// output.
+func runGit(args ...string) error {
+	cmd := exec.Command("git", args...)
+	// The output is matched against, so keep it in English.
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+
+	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("Error creating file .git-ratchet-note %s", err)
+		return fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(string(output)))
 	}
-	defer os.Remove(notepath)
 
-	err = writef(tempfile)
+	return nil
+}
+
+// MergeNotes merges the notes commit theirs into refs/notes/<ref>. Notes only
+// one side has are kept, and notes both sides have are merged with merge.
+func MergeNotes(repo *git.Repository, ref string, theirs plumbing.Hash, merge MergeFunc) error {
+	theirCommit, err := repo.CommitObject(theirs)
 	if err != nil {
-		return fmt.Errorf("Error writing notes to .git-ratchet-note %s", err)
+		return err
 	}
 
-	err = tempfile.Close()
+	theirBlobs, _, err := readNotesCommit(repo, theirs)
 	if err != nil {
-		return fmt.Errorf("Error closing .git-ratchet-note %s", err)
+		return err
 	}
 
-	writenotes := exec.Command("git", "notes", "--ref="+ref, "add", "-f", "-F", notepath)
+	return UpdateNotes(repo, ref, "Notes merged by 'git ratchet'", func(notes *Notes) error {
+		if notes.ref == nil {
+			notes.forward = theirs
+			notes.changed = true
+			return nil
+		}
+
+		ours, err := repo.CommitObject(notes.ref.Hash())
+		if err != nil {
+			return err
+		}
+
+		// Nothing to do when we already have their notes.
+		if ours.Hash == theirs {
+			return nil
+		}
+		if merged, err := theirCommit.IsAncestor(ours); err != nil || merged {
+			return err
+		}
+
+		if behind, err := ours.IsAncestor(theirCommit); err != nil || behind {
+			notes.forward = theirs
+			notes.changed = true
+			return err
+		}
+
+		for commit, blob := range theirBlobs {
+			ourBlob, ok := notes.blobs[commit]
+			if !ok {
+				notes.set(commit, blob)
+				continue
+			}
+			if ourBlob == blob {
+				continue
+			}
+
+			ourNote, err := notes.Note(commit)
+			if err != nil {
+				return err
+			}
+
+			theirNote, err := (&Notes{repo: repo, blobs: theirBlobs}).Note(commit)
+			if err != nil {
+				return err
+			}
 
-	log.INFO.Println(strings.Join(writenotes.Args, " "))
+			note, err := merge(ourNote, theirNote)
+			if err != nil {
+				return fmt.Errorf("Error merging notes on %s: %s", commit, err)
+			}
 
-	bytes, err := writenotes.CombinedOutput()
+			err = notes.SetNote(commit, note)
+			if err != nil {
+				return err
+			}
+		}
 
+		notes.merged = theirs
+		notes.changed = true
+		return nil
+	})
+}
+
+// History walks the commits reachable from a commit, most recently committed
+// first, like git log.
+type History struct {
+	repo      *git.Repository
+	pending   []*object.Commit
+	seen      map[plumbing.Hash]bool
+	truncated bool
+	// firstParent follows only the first parent of merge commits.
+	firstParent bool
+	// excluded marks the commits reachable from an excluded commit, which
+	// are walked alongside the others but not returned.
+	excluded map[plumbing.Hash]bool
+	// included counts the pending commits which aren't excluded. The walk
+	// is over once there are none.
+	included int
+}
+
+// NewHistory walks the commits reachable from head, but not from any of the
+// excluded commits, like git log head ^exclude. Both sides are walked together
+// by commit date, so only as much of the excluded history is read as it takes
+// to reach the commits from head.
+func NewHistory(repo *git.Repository, head plumbing.Hash, exclude ...plumbing.Hash) (*History, error) {
+	h := &History{repo: repo, seen: make(map[plumbing.Hash]bool), excluded: make(map[plumbing.Hash]bool)}
+
+	err := h.push(head, false)
 	if err != nil {
-		return fmt.Errorf("Error writing notes %s, %s", err, string(bytes))
+		return nil, err
+	}
+
+	for _, e := range exclude {
+		err := h.push(e, true)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return err
+	return h, nil
 }
 
-func PushNotes(ref string) error {
-	pushnotes := exec.Command("git", "push", "origin", "refs/notes/"+ref)
-	log.INFO.Println(strings.Join(pushnotes.Args, " "))
+// NewHeadHistory walks the commits reachable from HEAD. An empty repository
+// has no history.
+func NewHeadHistory(repo *git.Repository) (*History, error) {
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return &History{repo: repo, seen: make(map[plumbing.Hash]bool)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHistory(repo, head.Hash())
+}
 
-	bytes, err := pushnotes.CombinedOutput()
+func (h *History) push(hash plumbing.Hash, excluded bool) error {
+	if h.seen[hash] {
+		if excluded && !h.excluded[hash] {
+			// Reached from an excluded commit after all. If it's still
+			// pending, its exclusion is passed on when it's walked.
+			h.excluded[hash] = true
+			for _, c := range h.pending {
+				if c.Hash == hash {
+					h.included--
+				}
+			}
+		}
+		return nil
+	}
+	h.seen[hash] = true
 
+	commit, err := h.repo.CommitObject(hash)
+	if err == plumbing.ErrObjectNotFound {
+		// Shallow clones are missing the commits past their depth.
+		if !excluded {
+			log.INFO.Printf("Commit %s not found, stopping history walk", hash)
+			h.truncated = true
+		}
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("Error pushing notes %s, %s", err, bytes)
+		return err
+	}
+
+	if excluded {
+		h.excluded[hash] = true
+	} else {
+		h.included++
 	}
 
-	return err
+	// Keep the pending commits sorted, most recently committed last. Commits
+	// made at the same time are walked in the order they were reached, as git
+	// does, so an excluded commit gets to exclude its parents first.
+	i := sort.Search(len(h.pending), func(i int) bool {
+		return !h.pending[i].Committer.When.Before(commit.Committer.When)
+	})
+	h.pending = append(h.pending, nil)
+	copy(h.pending[i+1:], h.pending[i:])
+	h.pending[i] = commit
+
+	return nil
+}
+
+// Truncated reports whether the walk so far was cut short by missing commits,
+// as in a shallow clone.
+func (h *History) Truncated() bool {
+	return h.truncated
+}
+
+// Next returns the next commit in the history, or io.EOF at the end.
+func (h *History) Next() (*object.Commit, error) {
+	for h.included > 0 {
+		commit := h.pending[len(h.pending)-1]
+		h.pending = h.pending[:len(h.pending)-1]
+
+		excluded := h.excluded[commit.Hash]
+		if !excluded {
+			h.included--
+		}
+
+		parents := commit.ParentHashes
+		if h.firstParent && len(parents) > 1 {
+			parents = parents[:1]
+		}
+
+		for _, parent := range parents {
+			err := h.push(parent, excluded)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !excluded {
+			return commit, nil
+		}
+	}
+
+	return nil, io.EOF
+}
+
+// NewFirstParentHistory walks the commits from head following only the first
+// parent of merge commits, which is the history of the branch itself, like git
+// log --first-parent.
+func NewFirstParentHistory(repo *git.Repository, head plumbing.Hash) (*History, error) {
+	h := &History{repo: repo, seen: make(map[plumbing.Hash]bool), excluded: make(map[plumbing.Hash]bool), firstParent: true}
+
+	err := h.push(head, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// NewFirstParentHeadHistory walks the first parents from HEAD. An empty
+// repository has no history.
+func NewFirstParentHeadHistory(repo *git.Repository) (*History, error) {
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return &History{repo: repo, seen: make(map[plumbing.Hash]bool)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFirstParentHistory(repo, head.Hash())
+}
+
+// NewBaseHistory walks the history of the base branch, as a pull request from
+// HEAD into base would be compared against. It starts from the latest commit on
+// the first parent history of base which HEAD contains, and follows the first
+// parents of base from there.
+func NewBaseHistory(repo *git.Repository, base string) (*History, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(base))
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving base %s: %s", base, err)
+	}
+
+	// A merge-base may sit on a side branch which was merged into base, and
+	// there may be several, so look for base's own commits in HEAD instead.
+	contains := make(map[plumbing.Hash]bool)
+
+	h, err := NewHistory(repo, head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := NewFirstParentHistory(repo, *hash)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		c, err := b.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("HEAD has no history in common with %s", base)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The history of HEAD only needs reading back as far as the commit,
+		// as it's walked most recently committed first.
+		for len(h.pending) > 0 && !h.pending[len(h.pending)-1].Committer.When.Before(c.Committer.When) {
+			hc, err := h.Next()
+			if err != nil {
+				return nil, err
+			}
+			contains[hc.Hash] = true
+		}
+
+		if contains[c.Hash] {
+			log.INFO.Printf("Base commit on %s is %s", base, c.Hash)
+			return NewFirstParentHistory(repo, c.Hash)
+		}
+	}
 }
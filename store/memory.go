@@ -0,0 +1,183 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// MemoryStore keeps measures and exclusions in memory, against a linear
+// history of commits made with Commit. It's meant for tests, and doesn't need
+// a git repository.
+type MemoryStore struct {
+	// Committer is recorded against the measures stored.
+	Committer string
+	commits   []memoryCommit
+}
+
+type memoryCommit struct {
+	hash       string
+	timestamp  time.Time
+	measures   []Measure
+	exclusions []Exclusion
+	// used are the IDs of the exclusions used by the measures.
+	used []string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Commit adds a commit to the history, and moves HEAD to it.
+func (s *MemoryStore) Commit(hash string) {
+	s.commits = append(s.commits, memoryCommit{hash: hash, timestamp: time.Now()})
+}
+
+func (s *MemoryStore) head() (*memoryCommit, error) {
+	if len(s.commits) == 0 {
+		return nil, errors.New("No commits in the memory store")
+	}
+	return &s.commits[len(s.commits)-1], nil
+}
+
+// CommitMeasures walks the linear history, ignoring the options.
+func (s *MemoryStore) CommitMeasures(opts HistoryOptions) (func() (CommitMeasure, error), error) {
+	i := len(s.commits)
+
+	return func() (CommitMeasure, error) {
+		for i > 0 {
+			i--
+			c := s.commits[i]
+			if len(c.measures) > 0 {
+				measures := make([]Measure, len(c.measures))
+				copy(measures, c.measures)
+				return CommitMeasure{CommitHash: c.hash, Timestamp: c.timestamp, Committer: s.Committer, Measures: measures}, nil
+			}
+		}
+		return CommitMeasure{}, io.EOF
+	}, nil
+}
+
+func (s *MemoryStore) PutMeasures(m []Measure, info RunInfo) error {
+	head, err := s.head()
+	if err != nil {
+		return err
+	}
+
+	head.measures = make([]Measure, len(m))
+	copy(head.measures, m)
+	sort.Sort(ByName(head.measures))
+	head.used = exclusionIDs(head.exclusions)
+	return nil
+}
+
+func (s *MemoryStore) Exclusions(hash string) ([]Exclusion, error) {
+	exclusions := make([]Exclusion, 0)
+
+	for i := len(s.commits) - 1; i >= 0; i-- {
+		exclusions = append(exclusions, s.commits[i].listExclusions()...)
+		if s.commits[i].hash == hash {
+			return unusedExclusions(uniqueExclusions(exclusions), s.commits[i].used), nil
+		}
+	}
+
+	return []Exclusion{}, errors.New("Commit " + hash + " not found in the memory store")
+}
+
+func (s *MemoryStore) ListExclusions() ([]Exclusion, error) {
+	exclusions := make([]Exclusion, 0)
+
+	for i := len(s.commits) - 1; i >= 0; i-- {
+		exclusions = append(exclusions, s.commits[i].listExclusions()...)
+	}
+
+	return exclusions, nil
+}
+
+// listExclusions gives the exclusions on the commit, as they're read back.
+func (c memoryCommit) listExclusions() []Exclusion {
+	exclusions := make([]Exclusion, 0, len(c.exclusions))
+	for _, ex := range c.exclusions {
+		ex.Commit = c.hash
+		ex.Timestamp = c.timestamp
+		exclusions = append(exclusions, ex)
+	}
+	return exclusions
+}
+
+func (s *MemoryStore) PutExclusion(ex Exclusion) error {
+	head, err := s.head()
+	if err != nil {
+		return err
+	}
+
+	return s.UpdateExclusions([]string{head.hash}, AppendExclusion(ex))
+}
+
+func (s *MemoryStore) UpdateExclusions(hashes []string, update func(hash string, exclusions []Exclusion) ([]Exclusion, error)) error {
+	for _, hash := range hashes {
+		c, err := s.find(hash)
+		if err != nil {
+			return err
+		}
+
+		exclusions, err := update(hash, append([]Exclusion{}, c.exclusions...))
+		if err != nil {
+			return err
+		}
+
+		c.exclusions = exclusions
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) find(hash string) (*memoryCommit, error) {
+	for i := range s.commits {
+		if s.commits[i].hash == hash {
+			return &s.commits[i], nil
+		}
+	}
+	return nil, errors.New("Commit " + hash + " not found in the memory store")
+}
+
+func (s *MemoryStore) CommitsSince(hash string) (int, error) {
+	for i := len(s.commits) - 1; i >= 0; i-- {
+		if s.commits[i].hash == hash {
+			return len(s.commits) - 1 - i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s isn't in the memory store", ErrCommitNotFound, hash)
+}
+
+// Reaches compares the positions of the commits in the linear history.
+func (s *MemoryStore) Reaches(hash string, commit string) (bool, error) {
+	i, j := -1, -1
+	for k, c := range s.commits {
+		if c.hash == hash {
+			i = k
+		}
+		if c.hash == commit {
+			j = k
+		}
+	}
+
+	if i < 0 {
+		return false, errors.New("Commit " + hash + " not found in the memory store")
+	}
+
+	return j >= 0 && j <= i, nil
+}
+
+// Fetch does nothing, there's nowhere to fetch from.
+func (s *MemoryStore) Fetch() error {
+	return nil
+}
+
+// Push does nothing, there's nowhere to push to.
+func (s *MemoryStore) Push() error {
+	return nil
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Migrate converts every version 1 note under git-ratchet-1-<prefix> into a
+// version 2 note under git-ratchet-2-<prefix>, in a single notes commit,
+// returning the number of notes converted. Commits which already have a
+// version 2 note are left alone, so migrating twice is harmless. The version 1
+// notes are kept, for older versions of git-ratchet and for rolling back.
+func (s *GitStore) Migrate(tool string, dryRun bool) (int, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return 0, err
+	}
+
+	legacy, err := ReadNotes(repo, s.legacyMeasuresRef())
+	if err != nil {
+		return 0, err
+	}
+
+	var migrated int
+
+	err = UpdateNotes(repo, s.measuresRef(), "Notes migrated by 'git ratchet'", func(notes *Notes) error {
+		migrated = 0
+
+		for _, commit := range legacy.Commits() {
+			existing, err := notes.Note(commit)
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				continue
+			}
+
+			measures, err := legacyMeasures(legacy, commit)
+			if err != nil {
+				return err
+			}
+			if len(measures) == 0 {
+				continue
+			}
+
+			note := NewNote(measures, RunInfo{Tool: tool})
+			note.MigratedFrom = 1
+
+			// Version 1 notes don't record when they were written, so date
+			// the note by its commit rather than by the migration.
+			if c, err := repo.CommitObject(commit); err == nil {
+				note.Timestamp = c.Committer.When.UTC()
+			}
+
+			var b bytes.Buffer
+			err = WriteNote(note, &b)
+			if err != nil {
+				return err
+			}
+
+			migrated++
+			if dryRun {
+				continue
+			}
+
+			err = notes.SetNote(commit, b.String())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return migrated, err
+}
+
+// VerifyMigration checks every version 1 note has a version 2 note, and that
+// the measures of migrated notes match, returning the number of notes checked.
+func (s *GitStore) VerifyMigration() (int, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return 0, err
+	}
+
+	legacy, err := ReadNotes(repo, s.legacyMeasuresRef())
+	if err != nil {
+		return 0, err
+	}
+
+	notes, err := ReadNotes(repo, s.measuresRef())
+	if err != nil {
+		return 0, err
+	}
+
+	verified := 0
+
+	for _, commit := range legacy.Commits() {
+		measures, err := legacyMeasures(legacy, commit)
+		if err != nil {
+			return verified, err
+		}
+		if len(measures) == 0 {
+			continue
+		}
+
+		text, err := notes.Note(commit)
+		if err != nil {
+			return verified, err
+		}
+		if len(text) == 0 {
+			return verified, fmt.Errorf("Note on %s hasn't been migrated", commit)
+		}
+
+		note, err := ParseNote(strings.NewReader(text))
+		if err != nil {
+			return verified, fmt.Errorf("Error reading migrated note on %s: %s", commit, err)
+		}
+
+		// Notes written since by check replace the migrated note, and needn't
+		// match.
+		if note.MigratedFrom != 0 && !sameMeasures(measures, note.StoredMeasures()) {
+			return verified, fmt.Errorf("Migrated note on %s doesn't match the original", commit)
+		}
+
+		verified++
+	}
+
+	return verified, nil
+}
+
+// RollbackMigration removes the notes written by Migrate, returning the number
+// of notes removed. Notes written since by check are kept.
+func (s *GitStore) RollbackMigration() (int, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+
+	err = UpdateNotes(repo, s.measuresRef(), "Notes migration rolled back by 'git ratchet'", func(notes *Notes) error {
+		removed = 0
+
+		for _, commit := range notes.Commits() {
+			text, err := notes.Note(commit)
+			if err != nil {
+				return err
+			}
+
+			note, err := ParseNote(strings.NewReader(text))
+			if err != nil {
+				return fmt.Errorf("Error reading note on %s: %s", commit, err)
+			}
+
+			if note.MigratedFrom != 0 {
+				notes.RemoveNote(commit)
+				removed++
+			}
+		}
+
+		return nil
+	})
+
+	return removed, err
+}
+
+func legacyMeasures(legacy *Notes, commit plumbing.Hash) ([]Measure, error) {
+	text, err := legacy.Note(commit)
+	if err != nil || len(text) == 0 {
+		return nil, err
+	}
+
+	measures, err := ParseMeasures(strings.NewReader(text), CSV, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading note on %s: %s", commit, err)
+	}
+
+	sort.Sort(ByName(measures))
+	return measures, nil
+}
+
+// sameMeasures reports whether the two lists hold the same measures, in the
+// same order.
+func sameMeasures(a []Measure, b []Measure) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
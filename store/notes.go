@@ -0,0 +1,414 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	log "github.com/spf13/jwalterweatherman"
+)
+
+// GitStore stores measures and exclusions in git notes, under the refs
+// git-ratchet-2-<prefix> and git-ratchet-excuse-1-<prefix>. The notes travel
+// with the repository, so this is the default store. Measures written to
+// git-ratchet-1-<prefix> by older versions are still read.
+type GitStore struct {
+	Prefix string
+	// Remote is the remote the notes are fetched from and pushed to.
+	Remote string
+	// fetched is set once the notes have been fetched from the remote.
+	fetched bool
+}
+
+func NewGitStore(prefix string) *GitStore {
+	return &GitStore{Prefix: prefix, Remote: "origin"}
+}
+
+func (s *GitStore) measuresRef() string {
+	return "git-ratchet-2-" + s.Prefix
+}
+
+func (s *GitStore) legacyMeasuresRef() string {
+	return "git-ratchet-1-" + s.Prefix
+}
+
+func (s *GitStore) exclusionsRef() string {
+	return "git-ratchet-excuse-1-" + s.Prefix
+}
+
+func (s *GitStore) CommitMeasures(opts HistoryOptions) (func() (CommitMeasure, error), error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	notes, err := ReadNotes(repo, s.measuresRef())
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, err := ReadNotes(repo, s.legacyMeasuresRef())
+	if err != nil {
+		return nil, err
+	}
+
+	stored := notes.Exists() || legacy.Exists() || s.fetched || !hasRemote(repo, s.Remote)
+
+	return historyMeasures(opts, stored, func(commit plumbing.Hash) ([]Measure, error) {
+		note, err := notes.Note(commit)
+		if err != nil {
+			return nil, err
+		}
+		if len(note) > 0 {
+			n, err := ParseNote(strings.NewReader(note))
+			if err != nil {
+				return nil, err
+			}
+			return n.StoredMeasures(), nil
+		}
+
+		// Fall back to a version 1 note, which needs to be non-empty to
+		// contain measures.
+		note, err = legacy.Note(commit)
+		if err != nil || len(note) == 0 {
+			return nil, err
+		}
+
+		return ParseMeasures(strings.NewReader(note), CSV, nil)
+	})
+}
+
+func (s *GitStore) PutMeasures(m []Measure, info RunInfo) error {
+	repo, err := OpenRepository()
+	if err != nil {
+		return err
+	}
+
+	head, err := headHash()
+	if err != nil {
+		return fmt.Errorf("Error writing notes %s", err)
+	}
+
+	notes, err := ReadNotes(repo, s.exclusionsRef())
+	if err != nil {
+		return err
+	}
+
+	exclusions, err := readExclusions(notes)(head)
+	if err != nil {
+		return err
+	}
+
+	note := NewNote(m, info)
+	note.Excuses = exclusionIDs(exclusions)
+
+	writef := func(w io.Writer) error {
+		return WriteNote(note, w)
+	}
+
+	return WriteNotes(writef, s.measuresRef())
+}
+
+func (s *GitStore) Exclusions(hash string) ([]Exclusion, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	notes, err := ReadNotes(repo, s.exclusionsRef())
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	used, err := s.usedExclusions(repo, hash)
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	exclusions, err := historyExclusions(hash, readExclusions(notes))
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	return unusedExclusions(exclusions, used), nil
+}
+
+// usedExclusions gives the IDs of the exclusions recorded as used by the
+// measures stored on the commit. Version 1 notes don't record them.
+func (s *GitStore) usedExclusions(repo *git.Repository, hash string) ([]string, error) {
+	notes, err := ReadNotes(repo, s.measuresRef())
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := notes.Note(plumbing.NewHash(hash))
+	if err != nil || len(text) == 0 {
+		return nil, err
+	}
+
+	note, err := ParseNote(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+
+	return note.Excuses, nil
+}
+
+func (s *GitStore) ListExclusions() ([]Exclusion, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	notes, err := ReadNotes(repo, s.exclusionsRef())
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	return listExclusions(notes.Commits(), readExclusions(notes))
+}
+
+// readExclusions reads the exclusions noted on a commit.
+func readExclusions(notes *Notes) func(commit plumbing.Hash) ([]Exclusion, error) {
+	return func(commit plumbing.Hash) ([]Exclusion, error) {
+		record, err := notes.Note(commit)
+		if err != nil || len(record) == 0 {
+			return nil, err
+		}
+
+		return ParseExclusions(record)
+	}
+}
+
+func (s *GitStore) PutExclusion(ex Exclusion) error {
+	head, err := headHash()
+	if err != nil {
+		return fmt.Errorf("Error writing notes %s", err)
+	}
+
+	return s.UpdateExclusions([]string{head.String()}, AppendExclusion(ex))
+}
+
+func (s *GitStore) UpdateExclusions(hashes []string, update func(hash string, exclusions []Exclusion) ([]Exclusion, error)) error {
+	repo, err := OpenRepository()
+	if err != nil {
+		return err
+	}
+
+	err = UpdateNotes(repo, s.exclusionsRef(), "Excuses updated by 'git ratchet'", func(notes *Notes) error {
+		for _, hash := range hashes {
+			commit := plumbing.NewHash(hash)
+			log.INFO.Printf("Writing excuses on %s under %s", commit, notesRefName(s.exclusionsRef()))
+
+			exclusions, err := readExclusions(notes)(commit)
+			if err != nil {
+				return err
+			}
+
+			exclusions, err = update(hash, exclusions)
+			if err != nil {
+				return err
+			}
+
+			if len(exclusions) == 0 {
+				notes.RemoveNote(commit)
+				continue
+			}
+
+			var b bytes.Buffer
+			err = WriteExclusions(exclusions, &b)
+			if err != nil {
+				return err
+			}
+
+			err = notes.SetNote(commit, b.String())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing notes %s", err)
+	}
+
+	return nil
+}
+
+func (s *GitStore) CommitsSince(hash string) (int, error) {
+	return commitsSince(hash)
+}
+
+func (s *GitStore) Reaches(hash string, commit string) (bool, error) {
+	return reaches(hash, commit)
+}
+
+// Fetch fetches the notes refs from the remote, merging them into the local
+// notes refs. Notes written by older versions are fetched too.
+func (s *GitStore) Fetch() error {
+	repo, err := OpenRepository()
+	if err != nil {
+		return err
+	}
+
+	merges := map[string]MergeFunc{
+		s.measuresRef():       MergeMeasureNotes,
+		s.legacyMeasuresRef(): keepOurs,
+		s.exclusionsRef():     MergeExclusionNotes,
+	}
+
+	for _, ref := range []string{s.measuresRef(), s.legacyMeasuresRef(), s.exclusionsRef()} {
+		err = FetchNotes(repo, s.Remote, ref, merges[ref])
+		if err != nil {
+			return fmt.Errorf("Error fetching notes %s", err)
+		}
+	}
+
+	s.fetched = true
+	return nil
+}
+
+// Push pushes the notes refs which exist to the remote, merging in any notes
+// pushed by others in the meantime. A repository without the remote has
+// nowhere to push to, so nothing is pushed.
+func (s *GitStore) Push() error {
+	repo, err := OpenRepository()
+	if err != nil {
+		return err
+	}
+
+	if !hasRemote(repo, s.Remote) {
+		log.WARN.Printf("No remote %s to push notes to", s.Remote)
+		return nil
+	}
+
+	merges := map[string]MergeFunc{
+		s.measuresRef():   MergeMeasureNotes,
+		s.exclusionsRef(): MergeExclusionNotes,
+	}
+
+	for _, ref := range []string{s.measuresRef(), s.exclusionsRef()} {
+		notes, err := ReadNotes(repo, ref)
+		if err != nil {
+			return err
+		}
+		if !notes.Exists() {
+			continue
+		}
+
+		err = PushNotes(s.Remote, ref, merges[ref])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keepOurs merges notes by keeping the local note.
+func keepOurs(ours string, theirs string) (string, error) {
+	return ours, nil
+}
+
+// MergeMeasureNotes merges two version 2 notes on the same commit, as written
+// by CI jobs checking the same commit at the same time. Where both notes hold
+// a measure the tighter baseline wins, so merging never loosens the ratchet,
+// and the excuses either note used are kept as used.
+func MergeMeasureNotes(ours string, theirs string) (string, error) {
+	ourNote, err := ParseNote(strings.NewReader(ours))
+	if err != nil {
+		return "", err
+	}
+
+	theirNote, err := ParseNote(strings.NewReader(theirs))
+	if err != nil {
+		return "", err
+	}
+
+	measures := make(map[string]NoteMeasure)
+	for _, m := range ourNote.Measures {
+		measures[m.Name] = m
+	}
+	for _, m := range theirNote.Measures {
+		if our, ok := measures[m.Name]; !ok || our.Direction.improves(our.Baseline, m.Baseline) {
+			measures[m.Name] = m
+		}
+	}
+
+	note := ourNote
+	if theirNote.Timestamp.After(note.Timestamp) {
+		note.Timestamp = theirNote.Timestamp
+	}
+
+	// An excuse used on either side has been used up.
+	used := make(map[string]bool)
+	note.Excuses = nil
+	for _, ids := range [][]string{ourNote.Excuses, theirNote.Excuses} {
+		for _, id := range ids {
+			if !used[id] {
+				used[id] = true
+				note.Excuses = append(note.Excuses, id)
+			}
+		}
+	}
+
+	note.Measures = make([]NoteMeasure, 0, len(measures))
+	for _, m := range measures {
+		note.Measures = append(note.Measures, m)
+	}
+	sort.Slice(note.Measures, func(i, j int) bool { return note.Measures[i].Name < note.Measures[j].Name })
+
+	var b bytes.Buffer
+	err = WriteNote(note, &b)
+	return b.String(), err
+}
+
+// MergeExclusionNotes merges the exclusions on the same commit, keeping those
+// written on either side. Where both sides hold the same exclusion and only one
+// has revoked it, the revocation is kept.
+func MergeExclusionNotes(ours string, theirs string) (string, error) {
+	ourExclusions, err := ParseExclusions(ours)
+	if err != nil {
+		return "", err
+	}
+
+	theirExclusions, err := ParseExclusions(theirs)
+	if err != nil {
+		return "", err
+	}
+
+	exclusions := ourExclusions
+	for _, their := range theirExclusions {
+		found := false
+		for i, our := range exclusions {
+			if sameExclusion(our, their) {
+				found = true
+				if our.Revoked == nil {
+					exclusions[i].Revoked = their.Revoked
+				}
+				break
+			}
+		}
+		if !found {
+			exclusions = append(exclusions, their)
+		}
+	}
+
+	var b bytes.Buffer
+	err = WriteExclusions(exclusions, &b)
+	return b.String(), err
+}
+
+// sameExclusion reports whether a and b are the same exclusion, perhaps one
+// revoked since. Exclusions written by older versions, without an ID, are told
+// apart by what they excuse.
+func sameExclusion(a Exclusion, b Exclusion) bool {
+	if a.ID != "" || b.ID != "" {
+		return a.ID == b.ID
+	}
+	return a.Committer == b.Committer && a.Excuse == b.Excuse && strings.Join(a.Measure, ",") == strings.Join(b.Measure, ",")
+}
@@ -8,11 +8,13 @@ import (
 	"errors"
 	log "github.com/spf13/jwalterweatherman"
 	"io"
-	"os/exec"
+	"math"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -22,69 +24,25 @@ func ParseInputType(input string) InputType {
 		return CSV
 	case "checkstyle":
 		return Checkstyle
+	case "junit":
+		return JUnit
+	case "sarif":
+		return SARIF
 	default:
 		return Unknown
 	}
 }
 
-func CommitMeasureCommand(prefix string) *exec.Cmd {
-	return GitLog("git-ratchet-1-"+prefix, "HEAD", `%H,%ae,%at,"%N",`)
-}
-
-func CommitMeasures(gitlog *exec.Cmd) (func() (CommitMeasure, error), error) {
-	stdout, err := gitlog.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-
-	output := csv.NewReader(stdout)
-	output.TrailingComma = true
-
-	err = gitlog.Start()
-	if err != nil {
-		return nil, err
-	}
-
-	return func() (CommitMeasure, error) {
-		for {
-			// The log is of the form commithash,committer,timestamp,note
-			// If note is empty, there's no set of Measures
-			record, err := output.Read()
-			if err != nil {
-				return CommitMeasure{}, err
-			}
-
-			// The note needs to be non-empty to contain measures.
-			if len(record[len(record)-1]) == 0 {
-				continue
-			}
-
-			timestamp, err := strconv.Atoi(strings.Trim(record[2], "\\\""))
-			if err != nil {
-				return CommitMeasure{}, err
-			}
-
-			measures, err := ParseMeasures(strings.NewReader(strings.Trim(record[3], "\\\"")), CSV)
-			if err != nil {
-				return CommitMeasure{}, err
-			}
-
-			if len(measures) > 0 {
-				return CommitMeasure{CommitHash: strings.Trim(record[0], "'"),
-					Committer: record[1],
-					Timestamp: time.Unix(int64(timestamp), 0),
-					Measures:  measures}, nil
-			}
-		}
-	}, nil
-}
-
-func ParseMeasures(r io.Reader, t InputType) ([]Measure, error) {
+func ParseMeasures(r io.Reader, t InputType, groupBy []string) ([]Measure, error) {
 	switch t {
 	case CSV:
 		return ParseMeasuresCSV(r)
 	case Checkstyle:
-		return ParseMeasuresCheckstyle(r)
+		return ParseMeasuresCheckstyle(r, groupBy)
+	case JUnit:
+		return ParseMeasuresJUnit(r, groupBy)
+	case SARIF:
+		return ParseMeasuresSARIF(r)
 	default:
 		return nil, errors.New("Unknown input type")
 	}
@@ -97,7 +55,7 @@ func ParseMeasuresCSV(r io.Reader) ([]Measure, error) {
 	measures := make([]Measure, 0)
 
 	for {
-		var baseline int
+		var baseline float64
 
 		arr, err := data.Read()
 		if err == io.EOF {
@@ -112,13 +70,13 @@ func ParseMeasuresCSV(r io.Reader) ([]Measure, error) {
 			return nil, errors.New("Badly formatted measures")
 		}
 
-		value, err := strconv.Atoi(arr[1])
+		value, err := ParseValue(arr[1])
 		if err != nil {
 			return nil, err
 		}
 
-		if len(arr) > 2 {
-			baseline, err = strconv.Atoi(arr[2])
+		if len(arr) > 2 && arr[2] != "" {
+			baseline, err = ParseValue(arr[2])
 			if err != nil {
 				return nil, err
 			}
@@ -126,7 +84,15 @@ func ParseMeasuresCSV(r io.Reader) ([]Measure, error) {
 			baseline = value
 		}
 
-		measure := Measure{Name: arr[0], Value: value, Baseline: baseline}
+		direction := LowerIsBetter
+		if len(arr) > 3 {
+			direction, err = ParseDirection(arr[3])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		measure := Measure{Name: arr[0], Value: value, Baseline: baseline, Direction: direction}
 		measures = append(measures, measure)
 	}
 
@@ -135,9 +101,152 @@ func ParseMeasuresCSV(r io.Reader) ([]Measure, error) {
 	return measures, nil
 }
 
-func ParseMeasuresCheckstyle(r io.Reader) ([]Measure, error) {
+// ParseMeasuresRegex reads measures from plain text output by matching it
+// against re. When re has no capture groups, the number of matching lines is
+// stored as the measure called name. Otherwise each match gives a value: from
+// the group named "value", or failing that the first group. When re has a
+// group named "name", each match is stored as name.<group>, otherwise the
+// last match is stored as name.
+func ParseMeasuresRegex(r io.Reader, name string, re *regexp.Regexp) ([]Measure, error) {
+	values := make(map[string]float64)
+
+	valueGroup := -1
+	nameGroup := -1
+	for i, group := range re.SubexpNames() {
+		switch group {
+		case "value":
+			valueGroup = i
+		case "name":
+			nameGroup = i
+		}
+	}
+	for i := 1; valueGroup < 0 && i <= re.NumSubexp(); i++ {
+		if i != nameGroup {
+			valueGroup = i
+		}
+	}
+	if re.NumSubexp() > 0 && valueGroup < 0 {
+		return nil, errors.New("No group for the measure value in regex " + re.String())
+	}
+
+	scanner := bufio.NewScanner(r)
+	lines := 0
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if re.NumSubexp() == 0 {
+			if re.MatchString(line) {
+				lines++
+			}
+			continue
+		}
+
+		for _, match := range re.FindAllStringSubmatch(line, -1) {
+			value, err := ParseValue(match[valueGroup])
+			if err != nil {
+				return nil, err
+			}
+
+			measure := name
+			if nameGroup >= 0 {
+				measure = name + "." + match[nameGroup]
+			}
+			values[measure] = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if re.NumSubexp() == 0 {
+		values[name] = float64(lines)
+	}
+
+	measures := make([]Measure, 0, len(values))
+	for measure, value := range values {
+		measures = append(measures, Measure{Name: measure, Value: value, Baseline: value})
+	}
+
+	sort.Sort(ByName(measures))
+
+	return measures, nil
+}
+
+// ParseValue parses a measure value. Values may be integers, as written by
+// older versions, or decimals.
+func ParseValue(s string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("Measure value is not a finite number: " + s)
+	}
+
+	return value, nil
+}
+
+// ParseDirection parses the optional fourth CSV column, which says whether
+// lower or higher values of a measure are better. An empty column is lower.
+func ParseDirection(s string) (Direction, error) {
+	switch strings.TrimSpace(s) {
+	case "", "lower":
+		return LowerIsBetter, nil
+	case "higher":
+		return HigherIsBetter, nil
+	default:
+		return LowerIsBetter, errors.New("Unknown measure direction: " + s)
+	}
+}
+
+// ParseMeasuresCheckstyle counts the errors in a checkstyle XML report as the
+// errors measure. Each entry in groupBy additionally breaks the errors down:
+// "severity" emits errors.severity.<severity>, "source" emits
+// errors.source.<source>, "file" emits errors.file.<path> and "dir" emits
+// errors.dir.<path> for the directory containing each file. "dir=N" groups by
+// the first N directories of each path instead.
+func ParseMeasuresCheckstyle(r io.Reader, groupBy []string) ([]Measure, error) {
+	groups := make([]func(file string, attrs map[string]string) string, 0, len(groupBy))
+
+	for _, g := range groupBy {
+		switch {
+		case g == "severity" || g == "source":
+			attr := g
+			groups = append(groups, func(file string, attrs map[string]string) string {
+				if attrs[attr] == "" {
+					return ""
+				}
+				return "errors." + attr + "." + attrs[attr]
+			})
+		case g == "file":
+			groups = append(groups, func(file string, attrs map[string]string) string {
+				return "errors.file." + file
+			})
+		case g == "dir":
+			groups = append(groups, func(file string, attrs map[string]string) string {
+				return "errors.dir." + path.Dir(file)
+			})
+		case strings.HasPrefix(g, "dir="):
+			depth, err := strconv.Atoi(strings.TrimPrefix(g, "dir="))
+			if err != nil || depth < 1 {
+				return nil, errors.New("Bad directory depth for checkstyle input: " + g)
+			}
+			groups = append(groups, func(file string, attrs map[string]string) string {
+				return "errors.dir." + dirPrefix(file, depth)
+			})
+		default:
+			return nil, errors.New("Unknown group for checkstyle input: " + g)
+		}
+	}
+
+	root, _ := RepositoryRoot()
+
 	decoder := xml.NewDecoder(r)
-	errors := 0
+	counts := map[string]int{"errors": 0}
+	file := ""
 
 	for {
 		t, _ := decoder.Token()
@@ -146,191 +255,621 @@ func ParseMeasuresCheckstyle(r io.Reader) ([]Measure, error) {
 		}
 		switch se := t.(type) {
 		case xml.StartElement:
-			if se.Name.Local == "error" {
-				errors++
+			switch se.Name.Local {
+			case "file":
+				for _, attr := range se.Attr {
+					if attr.Name.Local == "name" {
+						file = relativePath(root, attr.Value)
+					}
+				}
+			case "error":
+				counts["errors"]++
+
+				attrs := make(map[string]string)
+				for _, attr := range se.Attr {
+					attrs[attr.Name.Local] = attr.Value
+				}
+
+				for _, group := range groups {
+					if name := group(file, attrs); name != "" {
+						counts[name]++
+					}
+				}
 			}
 		}
 	}
 
-	return []Measure{{Name: "errors", Value: errors, Baseline: errors}}, nil
+	measures := make([]Measure, 0, len(counts))
+	for name, count := range counts {
+		measures = append(measures, Measure{Name: name, Value: float64(count), Baseline: float64(count)})
+	}
+
+	sort.Sort(ByName(measures))
+
+	return measures, nil
 }
 
-func CompareMeasures(prefix string, hash string, storedm []Measure, computedm []Measure, slack float64, usePercents bool, zeroOnMissing bool) ([]Measure, error) {
+// relativePath makes paths inside the repository relative to its root, so
+// measures named after files are the same wherever the repository is checked
+// out and whichever directory the check runs from. Paths always use forward
+// slashes.
+func relativePath(root string, p string) string {
+	if filepath.IsAbs(p) && root != "" {
+		if rel, err := filepath.Rel(root, p); err == nil && !strings.HasPrefix(rel, "..") {
+			p = rel
+		}
+	}
+	return filepath.ToSlash(p)
+}
+
+// dirPrefix returns at most the first depth directories of a file path.
+func dirPrefix(file string, depth int) string {
+	dirs := strings.Split(path.Dir(file), "/")
+	if len(dirs) > 0 && dirs[0] == "" {
+		// Keep the leading slash of an absolute path.
+		depth++
+	}
+	if len(dirs) > depth {
+		dirs = dirs[:depth]
+	}
+	return strings.Join(dirs, "/")
+}
+
+// ParseMeasuresJUnit counts the failed, errored and skipped test cases in a
+// JUnit / xUnit XML report, along with the total number of test cases, which
+// must not fall. Grouping by "suite" additionally emits the counts for each
+// test suite, named tests.<suite>.failures and so on.
+func ParseMeasuresJUnit(r io.Reader, groupBy []string) ([]Measure, error) {
+	perSuite := false
+	for _, g := range groupBy {
+		switch g {
+		case "suite":
+			perSuite = true
+		default:
+			return nil, errors.New("Unknown group for junit input: " + g)
+		}
+	}
+
+	decoder := xml.NewDecoder(r)
+
+	total := make(map[string]int)
+	suites := make(map[string]map[string]int)
+	suiteNames := make([]string, 0)
+
+	// The currently open test suites, innermost last.
+	stack := make([]string, 0)
+	// The outcomes already counted for the current test case, so a test case
+	// with several <failure> elements is only counted once.
+	var counted map[string]bool
+
+	for {
+		t, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch se := t.(type) {
+		case xml.StartElement:
+			switch se.Name.Local {
+			case "testsuite":
+				name := ""
+				for _, attr := range se.Attr {
+					if attr.Name.Local == "name" {
+						name = attr.Value
+					}
+				}
+				if _, ok := suites[name]; !ok {
+					suites[name] = make(map[string]int)
+					suiteNames = append(suiteNames, name)
+				}
+				stack = append(stack, name)
+			case "testcase":
+				counted = make(map[string]bool)
+				total["total"]++
+				if len(stack) > 0 {
+					suites[stack[len(stack)-1]]["total"]++
+				}
+			case "failure", "error", "skipped":
+				outcome := junitOutcomes[se.Name.Local]
+				if counted == nil || counted[outcome] {
+					continue
+				}
+				counted[outcome] = true
+				total[outcome]++
+				if len(stack) > 0 {
+					suites[stack[len(stack)-1]][outcome]++
+				}
+			}
+		case xml.EndElement:
+			switch se.Name.Local {
+			case "testsuite":
+				if len(stack) > 0 {
+					stack = stack[:len(stack)-1]
+				}
+			case "testcase":
+				counted = nil
+			}
+		}
+	}
+
+	measures := make([]Measure, 0)
+
+	for _, outcome := range junitOutcomes {
+		measures = append(measures, Measure{Name: "tests." + outcome, Value: float64(total[outcome]), Baseline: float64(total[outcome])})
+	}
+	measures = append(measures, Measure{Name: "tests.total", Value: float64(total["total"]), Baseline: float64(total["total"]), Direction: HigherIsBetter})
+
+	if perSuite {
+		for _, suite := range suiteNames {
+			if suite == "" {
+				continue
+			}
+			for _, outcome := range junitOutcomes {
+				v := float64(suites[suite][outcome])
+				measures = append(measures, Measure{Name: "tests." + suite + "." + outcome, Value: v, Baseline: v})
+			}
+			v := float64(suites[suite]["total"])
+			measures = append(measures, Measure{Name: "tests." + suite + ".total", Value: v, Baseline: v, Direction: HigherIsBetter})
+		}
+	}
+
+	sort.Sort(ByName(measures))
+
+	return measures, nil
+}
+
+// junitOutcomes maps the JUnit element marking a test case outcome to the
+// measure name it is counted under.
+var junitOutcomes = map[string]string{
+	"failure": "failures",
+	"error":   "errors",
+	"skipped": "skipped",
+}
+
+type sarifLog struct {
+	Runs []struct {
+		Tool struct {
+			Driver struct {
+				Rules []sarifRule `json:"rules"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleID    string `json:"ruleId"`
+			RuleIndex *int   `json:"ruleIndex"`
+			Rule      *struct {
+				ID    string `json:"id"`
+				Index *int   `json:"index"`
+			} `json:"rule"`
+			Level        string `json:"level"`
+			Kind         string `json:"kind"`
+			Suppressions []struct {
+				Status string `json:"status"`
+			} `json:"suppressions"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+type sarifRule struct {
+	ID                   string `json:"id"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+// ParseMeasuresSARIF counts the results in a SARIF 2.1.0 log. It emits the
+// total number of results as sarif.total, the number at each level as
+// sarif.level.<level> and the number for each rule as sarif.rule.<ruleId>.
+// Results which aren't failures, have the level none, or which have been
+// suppressed, aren't counted.
+func ParseMeasuresSARIF(r io.Reader) ([]Measure, error) {
+	var l sarifLog
+	err := json.NewDecoder(r).Decode(&l)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{
+		"sarif.total":         0,
+		"sarif.level.error":   0,
+		"sarif.level.warning": 0,
+		"sarif.level.note":    0,
+	}
+
+	for _, run := range l.Runs {
+		rules := run.Tool.Driver.Rules
+
+		for _, result := range run.Results {
+			if result.Kind != "" && result.Kind != "fail" {
+				continue
+			}
+
+			suppressed := false
+			for _, s := range result.Suppressions {
+				if s.Status == "" || s.Status == "accepted" {
+					suppressed = true
+				}
+			}
+			if suppressed {
+				continue
+			}
+
+			ruleID := result.RuleID
+			index := result.RuleIndex
+			if result.Rule != nil {
+				if ruleID == "" {
+					ruleID = result.Rule.ID
+				}
+				if index == nil {
+					index = result.Rule.Index
+				}
+			}
+
+			var rule *sarifRule
+			for i := range rules {
+				if (index != nil && *index == i) || (index == nil && rules[i].ID == ruleID) {
+					rule = &rules[i]
+					break
+				}
+			}
+			if rule != nil && ruleID == "" {
+				ruleID = rule.ID
+			}
+
+			// A result without a level takes the default level of its rule.
+			level := result.Level
+			if level == "" && rule != nil {
+				level = rule.DefaultConfiguration.Level
+			}
+			if level == "" {
+				level = "warning"
+			}
+			if level == "none" {
+				continue
+			}
+
+			counts["sarif.total"]++
+			counts["sarif.level."+level]++
+			if ruleID != "" {
+				counts["sarif.rule."+ruleID]++
+			}
+		}
+	}
+
+	measures := make([]Measure, 0, len(counts))
+	for name, count := range counts {
+		measures = append(measures, Measure{Name: name, Value: float64(count), Baseline: float64(count)})
+	}
+
+	sort.Sort(ByName(measures))
+
+	return measures, nil
+}
+
+// CompareMeasures checks the computed measures against the stored measures,
+// returning the measures to store and the result of checking each measure.
+func CompareMeasures(s Store, hash string, storedm []Measure, computedm []Measure, config Config) ([]Measure, []Result, error) {
 	if len(storedm) == 0 {
-		return computedm, errors.New("No stored measures to compare against.")
+		return computedm, NewResults(computedm), ErrNoStoredMeasures
 	}
 
-	excuses, err := GetExclusions(prefix, hash)
+	excuses, err := s.Exclusions(hash)
 
 	if err != nil {
-		return computedm, err
+		return computedm, nil, err
 	}
 
-	log.INFO.Printf("Total excuses %s", excuses)
+	excuses, err = activeExclusions(s, excuses)
+
+	if err != nil {
+		return computedm, nil, err
+	}
+
+	log.INFO.Printf("Total excuses %v", excuses)
 
 	failing := make([]*Measure, 0)
 	zeroMes := make([]Measure, 0)
+	results := make([]Result, 0, len(computedm))
+
+	missing := func(stored Measure) {
+		log.ERROR.Printf("Missing computed value for stored measure: %s", stored.Name)
+		result := Result{Name: stored.Name, Direction: stored.Direction, Baseline: stored.Baseline, Missing: true, Passed: true}
+		switch config.PolicyFor(stored.Name).Missing {
+		case MissingZero:
+			zeroMes = append(zeroMes, Measure{Name: stored.Name, Value: 0, Baseline: 0, Direction: stored.Direction})
+			result.Delta = -stored.Baseline
+			result.DeltaPercent = -100
+		case MissingIgnore:
+			log.WARN.Printf("Ignoring missing measure: %s", stored.Name)
+		default:
+			failing = append(failing, &stored)
+			result.Passed = false
+		}
+		results = append(results, result)
+	}
 
 	i := 0
 	j := 0
 
-	exc := 0
-
 	for i < len(storedm) && j < len(computedm) {
 		stored := storedm[i]
 		computed := computedm[j]
 
 		log.INFO.Printf("Checking measures: %s %s", stored.Name, computed.Name)
 		if stored.Name < computed.Name {
-			log.ERROR.Printf("Missing computed value for stored measure: %s", stored.Name)
-			if zeroOnMissing {
-				zeroMes = append(zeroMes, Measure{Name: stored.Name, Value: 0, Baseline: 0})
-			} else {
-				failing = append(failing, &stored)
-			}
+			missing(stored)
 			i++
 		} else if computed.Name < stored.Name {
 			log.WARN.Printf("New measure found: %s", computed.Name)
+			results = append(results, NewResults([]Measure{computed})...)
 			j++
 		} else {
-			if computed.Baseline > stored.Baseline {
+			if computed.Direction != stored.Direction {
+				log.WARN.Printf("Measure direction changed: %s, now %s is better", computed.Name, computed.Direction)
+			}
+
+			// Once an excuse expires, the baseline from before it is back.
+			debt := stored.Debt
+			if debt != nil {
+				expired, err := debt.expired(s)
+				if err != nil {
+					return computedm, nil, err
+				}
+				if expired {
+					log.WARN.Printf("Excuse for %s expired, checking against the baseline of %g from before it", computed.Name, debt.Baseline)
+					stored.Baseline = debt.Baseline
+					debt = nil
+				}
+			}
+
+			// The baseline only ever moves in the direction of improvement.
+			if computed.Direction.improves(computed.Baseline, stored.Baseline) {
 				computed.Baseline = stored.Baseline
 				computedm[j].Baseline = stored.Baseline
 			}
 
 			delta := computed.Value - stored.Baseline
-			deltaPercent := 100.0
-			if stored.Baseline > 0 {
-				deltaPercent = float64(delta) * 100.0 / float64(stored.Baseline)
+			if computed.Direction == HigherIsBetter {
+				// Compare how far the measure has fallen.
+				delta = -delta
+			}
+			// A change from a baseline of zero counts as a change of 100%, in
+			// whichever direction it went.
+			deltaPercent := 0.0
+			if stored.Baseline != 0 {
+				deltaPercent = delta * 100.0 / math.Abs(stored.Baseline)
+			} else if delta != 0 {
+				deltaPercent = math.Copysign(100.0, delta)
 			}
 
 			// Compare the value
-			if deltaIsUnacceptable(delta, deltaPercent, slack, usePercents) {
-				log.ERROR.Printf("Measure rising: %s, delta %d (%g percents)", computed.Name, delta, deltaPercent)
-
-				if exc < len(excuses) {
-					ex := excuses[exc]
-
-					log.INFO.Printf("Checking excuses: %s %s", ex, computed)
-					if ex < computed.Name {
-						log.WARN.Printf("Exclusion found for not failing measure: %s", ex)
-						exc++
-						failing = append(failing, &computed)
-					} else if computed.Name < ex {
-						log.ERROR.Printf("No exclusion for failing measure: %s", computed.Name)
-						failing = append(failing, &computed)
-					} else {
-						log.WARN.Printf("Exclusion found for failing measure: %s", computed.Name)
-						computed.Baseline = computed.Value
-						computedm[j].Baseline = computed.Value
-						exc++
-					}
+			policy := config.PolicyFor(computed.Name)
+			result := Result{Name: computed.Name, Direction: computed.Direction, Baseline: stored.Baseline, Value: computed.Value,
+				Delta: computed.Value - stored.Baseline, Slack: policy.Slack, UsePercents: policy.UsePercents, Passed: true}
+			if computed.Direction == HigherIsBetter {
+				result.DeltaPercent = -deltaPercent
+			} else {
+				result.DeltaPercent = deltaPercent
+			}
+
+			if deltaIsUnacceptable(delta, deltaPercent, policy.Slack, policy.UsePercents) {
+				if computed.Direction == HigherIsBetter {
+					log.ERROR.Printf("Measure falling: %s, delta %g (%g percents)", computed.Name, -delta, -deltaPercent)
 				} else {
+					log.ERROR.Printf("Measure rising: %s, delta %g (%g percents)", computed.Name, delta, deltaPercent)
+				}
+
+				allowed, found := excusedDelta(excuses, computed.Name)
+				if !found {
+					log.ERROR.Printf("No exclusion for failing measure: %s", computed.Name)
 					failing = append(failing, &computed)
+					result.Passed = false
+				} else if delta-allowed > epsilon {
+					log.ERROR.Printf("Exclusion for failing measure %s allows a delta of at most %g", computed.Name, allowed)
+					failing = append(failing, &computed)
+					result.Passed = false
+				} else {
+					log.WARN.Printf("Exclusion found for failing measure: %s", computed.Name)
+					computed.Baseline = computed.Value
+					computedm[j].Baseline = computed.Value
+					result.Excused = true
+
+					// A debt still owed is kept, with the expiry of the new excuse.
+					baseline := stored.Baseline
+					if debt != nil {
+						baseline = debt.Baseline
+					}
+					debt = excuseDebt(excuses, computed.Name, baseline)
 				}
+			}
 
+			if debt != nil && !result.Excused && !computed.Direction.improves(computed.Value, debt.Baseline) {
+				log.INFO.Printf("Excused rise of %s paid back", computed.Name)
+				debt = nil
 			}
+			computedm[j].Debt = debt
+
+			results = append(results, result)
 			i++
 			j++
 		}
 	}
 
 	for i < len(storedm) {
-		stored := storedm[i]
-		log.ERROR.Printf("Missing computed value for stored measure: %s", stored.Name)
-		if zeroOnMissing {
-			zeroMes = append(zeroMes, Measure{Name: stored.Name, Value: 0, Baseline: 0})
-		} else {
-			failing = append(failing, &stored)
-		}
+		missing(storedm[i])
 		i++
 	}
 
 	for j < len(computedm) {
 		computed := computedm[j]
 		log.WARN.Printf("New measure found: %s", computed.Name)
+		results = append(results, NewResults([]Measure{computed})...)
 		j++
 	}
 
 	if len(failing) > 0 {
-		return computedm, errors.New("One or more metrics currently failing.")
+		return computedm, results, ErrMeasuresFailing
 	}
 
 	computedm = append(computedm, zeroMes...)
 	sort.Sort(ByName(computedm))
 
-	return computedm, nil
+	return computedm, results, nil
 }
 
-func deltaIsUnacceptable(delta int, deltaPercent float64, slack float64, usePercents bool) bool {
-	if usePercents {
-		return deltaPercent > slack
-	} else {
-		return float64(delta) > slack
+// NewResults gives the results for measures with nothing stored to compare
+// against, which always pass.
+func NewResults(measures []Measure) []Result {
+	results := make([]Result, 0, len(measures))
+	for _, m := range measures {
+		results = append(results, Result{Name: m.Name, Direction: m.Direction, Value: m.Value, New: true, Passed: true})
 	}
+	return results
 }
 
-func GetExclusions(prefix string, hash string) ([]string, error) {
-	ref := "git-ratchet-excuse-1-" + prefix
+// improves reports whether moving from value a to value b is an improvement.
+func (d Direction) improves(a float64, b float64) bool {
+	if d == HigherIsBetter {
+		return b > a
+	}
+	return b < a
+}
 
-	gitlog := GitLog(ref, hash+"^1..HEAD", "%N")
+// epsilon absorbs floating point error when comparing decimal values, so
+// 1.35 - 1.25 is within a slack of 0.1.
+const epsilon = 1e-9
 
-	stdout, err := gitlog.StdoutPipe()
-	if err != nil {
-		return []string{}, err
+func deltaIsUnacceptable(delta float64, deltaPercent float64, slack float64, usePercents bool) bool {
+	if usePercents {
+		return deltaPercent-slack > epsilon
+	} else {
+		return delta-slack > epsilon
 	}
+}
 
-	scanner := bufio.NewScanner(stdout)
+// ParseExclusions reads the exclusions on a commit, one JSON object per line.
+func ParseExclusions(record string) ([]Exclusion, error) {
+	log.INFO.Printf("Exclusions %s", record)
 
-	err = gitlog.Start()
-	if err != nil {
-		return []string{}, err
+	decoder := json.NewDecoder(strings.NewReader(strings.Trim(record, "'")))
+	exclusions := make([]Exclusion, 0, 1)
+
+	for {
+		var ex Exclusion
+		err := decoder.Decode(&ex)
+		if err == io.EOF {
+			return exclusions, nil
+		}
+		if err != nil {
+			return []Exclusion{}, err
+		}
+		exclusions = append(exclusions, ex)
 	}
+}
 
-	exclusions := make([]string, 0)
+// excuseDebt gives the debt owed for the named measure being excused, from
+// the baseline before, or nil if any of the exclusions excusing it doesn't
+// expire. The expiry of the most recent exclusion is used.
+func excuseDebt(excuses []Exclusion, name string, baseline float64) *Debt {
+	var debt *Debt
 
-	for scanner.Scan() {
-		record := strings.Trim(scanner.Text(), "'")
+	for _, ex := range excuses {
+		for _, m := range ex.Measure {
+			if m != name {
+				continue
+			}
 
-		if len(record) == 0 {
-			continue
+			if ex.Expires == nil && ex.ExpiresAfter == 0 {
+				return nil
+			}
+			if debt == nil {
+				debt = &Debt{Baseline: baseline, Commit: ex.Commit, Expires: ex.Expires, ExpiresAfter: ex.ExpiresAfter}
+			}
 		}
+	}
 
-		measures, err := ParseExclusion(record)
+	return debt
+}
 
-		if err != nil && err != io.EOF {
-			return []string{}, err
-		}
+// expired reports whether the excuse which raised the baseline has expired.
+func (d *Debt) expired(s Store) (bool, error) {
+	return expired(s, d.Commit, d.Expires, d.ExpiresAfter)
+}
 
-		exclusions = append(exclusions, measures...)
+// Expired reports whether the exclusion has expired, so it no longer excuses
+// anything.
+func (ex Exclusion) Expired(s Store) (bool, error) {
+	return expired(s, ex.Commit, ex.Expires, ex.ExpiresAfter)
+}
+
+// expired reports whether an excuse written on the commit has expired, by date
+// or by the number of commits since. When the commit is missing, the commits
+// since can't be counted, so it's only expired by date.
+func expired(s Store, commit string, expires *time.Time, after int) (bool, error) {
+	if expires != nil && !time.Now().Before(*expires) {
+		return true, nil
 	}
 
-	if err = scanner.Err(); err != nil {
-		return []string{}, err
+	if after > 0 {
+		commits, err := s.CommitsSince(commit)
+		if errors.Is(err, ErrCommitNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return commits >= after, nil
 	}
 
-	stdout.Close()
+	return false, nil
+}
 
-	err = gitlog.Wait()
+// activeExclusions leaves out the exclusions which have been revoked, or have
+// expired so they can't excuse the rise again.
+func activeExclusions(s Store, excuses []Exclusion) ([]Exclusion, error) {
+	active := make([]Exclusion, 0, len(excuses))
+	for _, ex := range excuses {
+		if ex.Revoked != nil {
+			log.INFO.Printf("Exclusion on %s revoked", ex.Commit)
+			continue
+		}
 
-	if err != nil && err != syscall.EPIPE {
-		return []string{}, err
+		lapsed, err := ex.Expired(s)
+		if err != nil {
+			return nil, err
+		}
+		if lapsed {
+			log.INFO.Printf("Exclusion on %s expired", ex.Commit)
+			continue
+		}
+		active = append(active, ex)
 	}
-
-	sort.Strings(exclusions)
-
-	return exclusions, nil
+	return active, nil
 }
 
-func ParseExclusion(ex string) ([]string, error) {
-	log.INFO.Printf("Exclusion %s", ex)
+// excusedDelta gives how far the exclusions let the named measure move in the
+// wrong direction, and whether any of them excuse it at all. The bounds of
+// several exclusions add up, and an unbounded exclusion allows any change.
+func excusedDelta(excuses []Exclusion, name string) (float64, bool) {
+	allowed := 0.0
+	found := false
 
-	var m Exclusion
-	err := json.Unmarshal([]byte(strings.Trim(ex, "'")), &m)
+	for _, ex := range excuses {
+		for _, m := range ex.Measure {
+			if m != name {
+				continue
+			}
 
-	if err != nil {
-		return []string{}, err
+			found = true
+			if ex.Max == nil {
+				allowed = math.Inf(1)
+			} else {
+				allowed += *ex.Max
+			}
+		}
 	}
 
-	return m.Measure, nil
+	return allowed, found
 }
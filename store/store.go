@@ -0,0 +1,479 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+var (
+	// ErrNoNotes is returned in place of io.EOF when nothing has been stored
+	// locally, but there's a remote it may not have been fetched from. It's
+	// usual on a fresh clone.
+	ErrNoNotes = errors.New("No stored measures found, fetch them with git ratchet sync")
+	// ErrShallowHistory is returned in place of io.EOF when the history walk
+	// stopped at missing commits, as in a shallow clone, so stored measures
+	// may have been missed.
+	ErrShallowHistory = errors.New("History cut short by a shallow clone, fetch the full history with git fetch --unshallow")
+	// ErrCommitNotFound is returned for a commit the repository doesn't have,
+	// like one which has been rebased away or not fetched.
+	ErrCommitNotFound = errors.New("Commit not found")
+	// ErrMeasuresFailing is returned by CompareMeasures when a measure has
+	// got worse than the stored baseline allows. Other errors from it mean
+	// the comparison couldn't be made.
+	ErrMeasuresFailing = errors.New("One or more metrics currently failing.")
+	// ErrNoStoredMeasures is returned by CompareMeasures when the stored note
+	// holds no measures, so there's nothing for the computed ones to fail.
+	ErrNoStoredMeasures = errors.New("No stored measures to compare against.")
+)
+
+// Store persists the measures written by check, and the exclusions written by
+// excuse, against the commits they were written on.
+type Store interface {
+	// CommitMeasures returns a function which gives each commit with stored
+	// measures, most recent first, and io.EOF once there are no more. If there
+	// may be more which couldn't be read, ErrNoNotes or ErrShallowHistory is
+	// returned instead of io.EOF.
+	CommitMeasures(opts HistoryOptions) (func() (CommitMeasure, error), error)
+	// PutMeasures stores the measures against HEAD, with the details of the
+	// run which produced them, recording the exclusions on HEAD as used.
+	PutMeasures(m []Measure, info RunInfo) error
+	// Exclusions reads the exclusions written between the commit hash and
+	// HEAD, including those written on the commit itself, most recent first.
+	// An exclusion written on a range of commits is read once, and those
+	// recorded as used by the measures stored on hash aren't read.
+	Exclusions(hash string) ([]Exclusion, error)
+	// ListExclusions reads every stored exclusion, whether HEAD can reach it or
+	// not, most recent first. An exclusion written on a range of commits is
+	// read from each of them.
+	ListExclusions() ([]Exclusion, error)
+	// PutExclusion adds the exclusion to those stored against HEAD.
+	PutExclusion(ex Exclusion) error
+	// UpdateExclusions replaces the exclusions stored against each of the
+	// commit hashes with those update gives, from the exclusions already there.
+	UpdateExclusions(hashes []string, update func(hash string, exclusions []Exclusion) ([]Exclusion, error)) error
+	// CommitsSince counts the commits after the commit hash, up to and
+	// including HEAD.
+	CommitsSince(hash string) (int, error)
+	// Reaches reports whether the commit is hash or one of its ancestors. A
+	// commit missing from the repository isn't.
+	Reaches(hash string, commit string) (bool, error)
+	// Fetch reads the measures and exclusions shared by others, where the
+	// store supports it.
+	Fetch() error
+	// Push shares the stored measures and exclusions, where the store supports
+	// it.
+	Push() error
+}
+
+// HistoryOptions selects the history searched for stored measures. By default
+// it's everything reachable from HEAD.
+type HistoryOptions struct {
+	// Base searches the history of the named branch instead, from its merge-base
+	// with HEAD, so a pull request is compared against its target branch. The
+	// first parents of the branch are always followed.
+	Base string
+	// FirstParent follows only the first parent of merge commits, so measures
+	// stored on merged branches are skipped.
+	FirstParent bool
+}
+
+// StoreConfig declares where measures are stored, in the config file.
+//
+//	store:
+//	  type: dir
+//	  path: .ratchet
+type StoreConfig struct {
+	// Type is git, which stores measures in git notes, or dir, which stores them
+	// as JSON files under Path. Defaults to git.
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+	// Remote is the remote git notes are fetched from and pushed to. Defaults
+	// to origin.
+	Remote string `yaml:"remote"`
+	// Fetch fetches the stored measures before every check.
+	Fetch bool `yaml:"fetch"`
+}
+
+// OpenStore opens the store declared in the config for the prefix.
+func OpenStore(c StoreConfig, prefix string) (Store, error) {
+	switch c.Type {
+	case "", "git":
+		s := NewGitStore(prefix)
+		if c.Remote != "" {
+			s.Remote = c.Remote
+		}
+		return s, nil
+	case "dir":
+		if c.Path == "" {
+			return nil, errors.New("The dir store needs a path")
+		}
+		path := c.Path
+		if !filepath.IsAbs(path) {
+			// Like the config file, a relative path is from the root of
+			// the worktree, wherever in it the command runs.
+			root, err := RepositoryRoot()
+			if err != nil {
+				return nil, err
+			}
+			path = filepath.Join(root, path)
+		}
+		return NewDirStore(filepath.Join(path, prefix)), nil
+	default:
+		return nil, errors.New("Unknown store type: " + c.Type)
+	}
+}
+
+// historyMeasures walks the history selected by opts, reading the measures of
+// each commit with read, and skipping commits without any. stored is whether
+// anything has been stored at all.
+func historyMeasures(opts HistoryOptions, stored bool, read func(commit plumbing.Hash) ([]Measure, error)) (func() (CommitMeasure, error), error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	var history *History
+	switch {
+	case opts.Base != "":
+		history, err = NewBaseHistory(repo, opts.Base)
+	case opts.FirstParent:
+		history, err = NewFirstParentHeadHistory(repo)
+	default:
+		history, err = NewHeadHistory(repo)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (CommitMeasure, error) {
+		for {
+			commit, err := history.Next()
+			if err == io.EOF && !stored {
+				return CommitMeasure{}, ErrNoNotes
+			}
+			if err == io.EOF && history.Truncated() {
+				return CommitMeasure{}, ErrShallowHistory
+			}
+			if err != nil {
+				return CommitMeasure{}, err
+			}
+
+			measures, err := read(commit.Hash)
+			if err != nil {
+				return CommitMeasure{}, err
+			}
+
+			if len(measures) > 0 {
+				return CommitMeasure{CommitHash: commit.Hash.String(),
+					Committer: commit.Author.Email,
+					Timestamp: time.Unix(commit.Author.When.Unix(), 0),
+					Measures:  measures}, nil
+			}
+		}
+	}, nil
+}
+
+// historyExclusions walks the history from HEAD back to the commit hash,
+// reading the exclusions on each commit with read.
+func historyExclusions(hash string, read func(commit plumbing.Hash) ([]Exclusion, error)) ([]Exclusion, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	history, err := sinceHistory(repo, hash)
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	exclusions := make([]Exclusion, 0)
+
+	for {
+		commit, err := history.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return []Exclusion{}, err
+		}
+
+		excluded, err := read(commit.Hash)
+		if err != nil {
+			return []Exclusion{}, err
+		}
+
+		for _, ex := range excluded {
+			ex.Commit = commit.Hash.String()
+			ex.Timestamp = time.Unix(commit.Author.When.Unix(), 0)
+			exclusions = append(exclusions, ex)
+		}
+	}
+
+	return uniqueExclusions(exclusions), nil
+}
+
+// listExclusions reads the exclusions on each of the commits with read, most
+// recent first. Commits missing from the repository, as when the exclusion was
+// fetched without them, are left undated and last.
+func listExclusions(commits []plumbing.Hash, read func(commit plumbing.Hash) ([]Exclusion, error)) ([]Exclusion, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return []Exclusion{}, err
+	}
+
+	exclusions := make([]Exclusion, 0, len(commits))
+
+	for _, hash := range commits {
+		excluded, err := read(hash)
+		if err != nil {
+			return []Exclusion{}, err
+		}
+
+		var timestamp time.Time
+		if commit, err := repo.CommitObject(hash); err == nil {
+			timestamp = time.Unix(commit.Author.When.Unix(), 0)
+		}
+
+		for _, ex := range excluded {
+			ex.Commit = hash.String()
+			ex.Timestamp = timestamp
+			exclusions = append(exclusions, ex)
+		}
+	}
+
+	sort.SliceStable(exclusions, func(i, j int) bool {
+		return exclusions[i].Timestamp.After(exclusions[j].Timestamp)
+	})
+
+	return exclusions, nil
+}
+
+// AppendExclusion gives the update adding the exclusion to those on each
+// commit, with a new ID if it doesn't have one.
+func AppendExclusion(ex Exclusion) func(hash string, exclusions []Exclusion) ([]Exclusion, error) {
+	if ex.ID == "" {
+		ex.ID = NewExclusionID()
+	}
+
+	return func(hash string, exclusions []Exclusion) ([]Exclusion, error) {
+		return append(exclusions, ex), nil
+	}
+}
+
+// uniqueExclusions leaves out the copies of an exclusion written on a range
+// of commits, keeping the first.
+func uniqueExclusions(exclusions []Exclusion) []Exclusion {
+	seen := make(map[string]bool)
+	unique := make([]Exclusion, 0, len(exclusions))
+
+	for _, ex := range exclusions {
+		if ex.ID != "" && seen[ex.ID] {
+			continue
+		}
+		seen[ex.ID] = true
+		unique = append(unique, ex)
+	}
+
+	return unique
+}
+
+// exclusionIDs gives the IDs of the exclusions, for recording them as used in
+// the note of the measures stored alongside them. Exclusions written by older
+// versions don't have an ID, and can't be recorded.
+func exclusionIDs(exclusions []Exclusion) []string {
+	ids := make([]string, 0, len(exclusions))
+	for _, ex := range exclusions {
+		if ex.ID != "" {
+			ids = append(ids, ex.ID)
+		}
+	}
+	return ids
+}
+
+// unusedExclusions drops the exclusions whose IDs are recorded as used by the
+// stored measures. Copies on other commits of an excuse written on a range are
+// dropped too, as they share its ID.
+func unusedExclusions(exclusions []Exclusion, used []string) []Exclusion {
+	if len(used) == 0 {
+		return exclusions
+	}
+
+	skip := make(map[string]bool, len(used))
+	for _, id := range used {
+		skip[id] = true
+	}
+
+	unused := make([]Exclusion, 0, len(exclusions))
+	for _, ex := range exclusions {
+		if ex.ID == "" || !skip[ex.ID] {
+			unused = append(unused, ex)
+		}
+	}
+
+	return unused
+}
+
+// ResolveCommit gives the hash of the commit named by the revision, such as
+// HEAD, a branch or an abbreviated hash.
+func ResolveCommit(rev string) (string, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+// ResolveRange gives the hashes of the commits in the range, given as from..to
+// like git log, where to defaults to HEAD. The range is given back with the
+// revisions resolved to hashes.
+func ResolveRange(rev string) ([]string, string, error) {
+	parts := strings.SplitN(rev, "..", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.HasPrefix(parts[1], ".") {
+		return nil, "", errors.New("Expected a range of commits as from..to, got " + rev)
+	}
+	if parts[1] == "" {
+		parts[1] = "HEAD"
+	}
+
+	repo, err := OpenRepository()
+	if err != nil {
+		return nil, "", err
+	}
+
+	from, err := repo.ResolveRevision(plumbing.Revision(parts[0]))
+	if err != nil {
+		return nil, "", fmt.Errorf("Error resolving %s: %s", parts[0], err)
+	}
+
+	to, err := repo.ResolveRevision(plumbing.Revision(parts[1]))
+	if err != nil {
+		return nil, "", fmt.Errorf("Error resolving %s: %s", parts[1], err)
+	}
+
+	history, err := NewHistory(repo, *to, *from)
+	if err != nil {
+		return nil, "", err
+	}
+
+	commits := make([]string, 0)
+	for {
+		commit, err := history.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		commits = append(commits, commit.Hash.String())
+	}
+
+	if len(commits) == 0 {
+		return nil, "", errors.New("No commits in the range " + rev)
+	}
+
+	return commits, from.String() + ".." + to.String(), nil
+}
+
+// commitsSince counts the commits from HEAD back to, but not including, the
+// commit hash.
+func commitsSince(hash string) (int, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return 0, err
+	}
+
+	history, err := sinceHistory(repo, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		commit, err := history.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if commit.Hash.String() != hash {
+			count++
+		}
+	}
+}
+
+// sinceHistory walks the commits from HEAD back to, and including, the commit
+// hash.
+func sinceHistory(repo *git.Repository, hash string) (*History, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	since, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err == plumbing.ErrObjectNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrCommitNotFound, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHistory(repo, head.Hash(), since.ParentHashes...)
+}
+
+// reaches reports whether the commit is hash or one of its ancestors.
+func reaches(hash string, commit string) (bool, error) {
+	if hash == commit {
+		return true, nil
+	}
+
+	repo, err := OpenRepository()
+	if err != nil {
+		return false, err
+	}
+
+	c, err := repo.CommitObject(plumbing.NewHash(commit))
+	if err == plumbing.ErrObjectNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	h, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return false, err
+	}
+
+	return c.IsAncestor(h)
+}
+
+// headHash is the hash of the commit HEAD points at.
+func headHash() (plumbing.Hash, error) {
+	repo, err := OpenRepository()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return head.Hash(), nil
+}
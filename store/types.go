@@ -9,13 +9,39 @@ type InputType int
 const (
 	CSV = iota
 	Checkstyle
+	JUnit
+	SARIF
 	Unknown
 )
 
+// Direction is the way a measure has to move to improve.
+type Direction int
+
+const (
+	// LowerIsBetter measures fail the check when they rise. This is the default.
+	LowerIsBetter Direction = iota
+	// HigherIsBetter measures, like test coverage, fail the check when they fall.
+	HigherIsBetter
+)
+
 type Measure struct {
-	Name     string
-	Value    int
-	Baseline int
+	Name      string    `json:"name"`
+	Value     float64   `json:"value"`
+	Baseline  float64   `json:"baseline"`
+	Direction Direction `json:"direction"`
+	// Debt is set while the baseline is raised by an excuse which expires.
+	Debt *Debt `json:"debt,omitempty"`
+}
+
+// Debt remembers the baseline from before an expiring excuse raised it. Once
+// the excuse expires the measure is checked against that baseline again, unless
+// it has already been paid back.
+type Debt struct {
+	Baseline float64 `json:"baseline"`
+	// Commit is the commit the excuse was written on.
+	Commit       string     `json:"commit"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	ExpiresAfter int        `json:"expiresAfter,omitempty"`
 }
 
 type CommitMeasure struct {
@@ -26,9 +52,60 @@ type CommitMeasure struct {
 }
 
 type Exclusion struct {
+	// ID tells the exclusion apart from others on the same commit, when
+	// merging notes. Exclusions written by older versions don't have one.
+	ID        string `json:",omitempty"`
 	Committer string
 	Excuse    string
 	Measure   []string
+	// Max bounds how far each excused measure may move in the wrong direction,
+	// in the measure's units. Without it, any change is excused.
+	Max *float64 `json:",omitempty"`
+	// Expires is when the raised baseline lapses, and ExpiresAfter the number
+	// of commits after which it does. Without either, it's kept for good.
+	Expires      *time.Time `json:",omitempty"`
+	ExpiresAfter int        `json:",omitempty"`
+	// Range is the range of commits the exclusion was written on, as
+	// from..to hashes, when it was written on more than one. It's copied onto
+	// each of them.
+	Range string `json:",omitempty"`
+	// Revoked is set once the exclusion is withdrawn, or replaced by an amended
+	// one. It's kept for the record, but excuses nothing.
+	Revoked *Revocation `json:",omitempty"`
+	// Commit is the commit the exclusion was written on, and Timestamp when
+	// that was authored. They're filled in when reading, rather than stored.
+	Commit    string    `json:"-"`
+	Timestamp time.Time `json:"-"`
+}
+
+// Revocation records who withdrew an exclusion, when and why.
+type Revocation struct {
+	Committer string
+	Reason    string
+	Timestamp time.Time
+	// Amended is set when the exclusion was replaced by an amended one, rather
+	// than withdrawn.
+	Amended bool `json:",omitempty"`
+}
+
+// Result is the outcome of checking a single measure against its stored
+// baseline. Delta and DeltaPercent are the change from the baseline, whichever
+// direction is better.
+type Result struct {
+	Name         string    `json:"name"`
+	Direction    Direction `json:"direction"`
+	Baseline     float64   `json:"baseline"`
+	Value        float64   `json:"value"`
+	Delta        float64   `json:"delta"`
+	DeltaPercent float64   `json:"deltaPercent"`
+	Slack        float64   `json:"slack"`
+	UsePercents  bool      `json:"usePercents"`
+	Excused      bool      `json:"excused"`
+	// New is set for measures with no stored baseline.
+	New bool `json:"new"`
+	// Missing is set for stored measures which weren't passed in.
+	Missing bool `json:"missing"`
+	Passed  bool `json:"passed"`
 }
 
 type ByName []Measure
@@ -37,6 +114,23 @@ func (a ByName) Len() int           { return len(a) }
 func (a ByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
 
+func (d Direction) String() string {
+	if d == HigherIsBetter {
+		return "higher"
+	}
+	return "lower"
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Direction) UnmarshalText(text []byte) error {
+	var err error
+	*d, err = ParseDirection(string(text))
+	return err
+}
+
 func (cm *CommitMeasure) String() string {
 	return cm.CommitHash
 }
@@ -1,32 +1,26 @@
 package store
 
 import (
+	"crypto/rand"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"sort"
 	"strconv"
-
-	log "github.com/spf13/jwalterweatherman"
 )
 
-func PutMeasures(prefix string, m []Measure) error {
-	writef := func(tempfile io.Writer) error {
-		err := WriteMeasures(m, tempfile)
-		if err != nil {
-			return err
-		}
-		return nil
-	}
-
-	return WriteNotes(writef, "git-ratchet-1-"+prefix)
-}
-
 func WriteMeasures(measures []Measure, w io.Writer) error {
 	out := csv.NewWriter(w)
 	sort.Sort(ByName(measures))
 	for _, m := range measures {
-		err := out.Write([]string{m.Name, strconv.Itoa(m.Value), strconv.Itoa(m.Baseline)})
+		record := []string{m.Name, FormatValue(m.Value), FormatValue(m.Baseline)}
+		// Only write the direction when it isn't the default, so notes stay
+		// readable by older versions.
+		if m.Direction != LowerIsBetter {
+			record = append(record, m.Direction.String())
+		}
+		err := out.Write(record)
 		if err != nil {
 			return err
 		}
@@ -35,31 +29,34 @@ func WriteMeasures(measures []Measure, w io.Writer) error {
 	return nil
 }
 
-func WriteExclusion(prefix string, ex Exclusion) error {
-	ref := "git-ratchet-excuse-1-" + prefix
+// FormatValue formats a measure value with as few digits as needed, so whole
+// numbers are written as integers.
+func FormatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
 
-	writef := func(tempfile io.Writer) error {
+// WriteExclusions writes the exclusions on a commit, one JSON object per line.
+// A single exclusion is written as older versions wrote it.
+func WriteExclusions(exclusions []Exclusion, w io.Writer) error {
+	for _, ex := range exclusions {
 		b, err := json.Marshal(ex)
-
 		if err != nil {
 			return err
 		}
 
-		tempfile.Write(b)
-		return nil
-	}
-
-	err := WriteNotes(writef, ref)
-
-	if err != nil {
-		return err
+		_, err = w.Write(append(b, '\n'))
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	err = PushNotes(ref)
-
-	if err != nil {
-		log.ERROR.Printf("Error while pushing notes: %s", err)
+// NewExclusionID gives a random ID for a new exclusion.
+func NewExclusionID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return ""
 	}
-
-	return nil
+	return hex.EncodeToString(b)
 }